@@ -1,254 +1,799 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"io"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+
+	"github.com/chzyer/readline"
 )
 
-var keywordsAutocomlete []string
-
-func initAutocomlete() {
-	keywords := []string{
-		"ADD COLUMN",
-		"AFTER",
-		"ALL",
-		"ALTER TABLE",
-		"ANY",
-		"ARRAY",
-		"ARRAY JOIN",
-		"AS",
-		"ASC",
-		"ASYNC",
-		"ATTACH PART",
-		"ATTACH PARTITION",
-		"ATTACH",
-		"BY",
-		"CASE",
-		"CHECK TABLE",
-		"CLEAR COLUMN",
-		"COLLATE",
-		"COORDINATE",
-		"COPY",
-		"CREATE",
-		"CROSS",
-		"DATABASE",
-		"DATABASES",
-		"DEDUPLICATE",
-		"DESC",
-		"DESCRIBE",
-		"DESCRIBE TABLE",
-		"DETACH",
-		"DETACH PARTITION",
-		"DISTINCT",
-		"DROP",
-		"DROP COLUMN",
-		"DROP PARTITION",
-		"ELSE",
-		"END",
-		"ENGINE",
-		"EXISTS",
-		"EXISTS TABLE",
-		"FETCH PARTITION",
-		"FINAL",
-		"FORMAT",
-		"FREEZE PARTITION",
-		"FROM",
-		"FULL",
-		"GROUP BY",
-		"GLOBAL",
-		"HAVING",
-		"IF EXISTS",
-		"IF NOT EXISTS",
-		"IN PARTITION",
-		"INNER",
-		"INSERT INTO",
-		"INTO",
-		"JOIN",
-		"KILL QUERY",
-		"LEFT",
-		"LEFT ARRAY JOIN",
-		"LIKE",
-		"LIMIT",
-		"LOCAL",
-		"MATERIALIZED",
-		"MODIFY COLUMN",
-		"MODIFY PRIMARY KEY",
-		"NAME",
-		"NOT",
-		"ON",
-		"OPTIMIZE TABLE",
-		"ORDER",
-		"ORDER BY",
-		"OUTFILE",
-		"PARTITION",
-		"POPULATE",
-		"PREWHERE",
-		"RENAME TABLE",
-		//		"RESHARD",
-		"RIGHT",
-		"SELECT",
-		"SHOW",
-		"SET",
-		"SETTINGS",
-		"SAMPLE",
-		"SHOW CREATE TABLE",
-		"SHOW PROCESSLIST",
-		"SYNC",
-		"TABLE",
-		"TABLES",
-		"TEMPORARY",
-		"TEST",
-		"THEN",
-		"TO",
-		"TOTALS",
-		"UNION",
-		"UNION ALL",
-		"USE",
-		"USING",
-		"VALUES",
-		"VIEW",
-		"WHEN",
-		"WHERE",
-		"WITH",
-
-		"AggregatingMergeTree",
-		"Buffer",
-		"CollapsingMergeTree",
-		"Distributed",
-		"File",
-		"Join",
-		"Kafka",
-		"Log",
-		"MaterializedView",
-		"Memory",
-		"Merge",
-		"MergeTree",
-		"Null",
-		"ReplacingMergeTree",
-		"ReplicatedAggregatingMergeTree",
-		"ReplicatedCollapsingMergeTree",
-		"ReplicatedMergeTree",
-		"ReplicatedReplacingMergeTree",
-		"ReplicatedSummingMergeTree",
-		"Set",
-		"SummingMergeTree",
-		"TinyLog",
-		"View",
-
-		// https://github.com/yandex/ClickHouse/blob/master/dbms/src/DataStreams/FormatFactory.cpp
-		"BlockTabSeparated",
-		"CapnProto",
-		"CSV",
-		"CSVWithNames",
-		"JSON",
-		"JSONCompact",
-		"JSONEachRow",
-		"Native",
-		"Null",
-		"Null",
-		"ODBCDriver",
-		"Pretty",
-		"PrettyCompact",
-		"PrettyCompactMonoBlock",
-		"PrettyCompactNoEscapes",
-		"PrettyNoEscapes",
-		"PrettySpace",
-		"PrettySpaceNoEscapes",
-		"RowBinary",
-		formatTabSeparated,
-		"TabSeparatedRaw",
-		"TabSeparatedWithNames",
-		"TabSeparatedWithNamesAndTypes",
-		"TSKV",
-		"TSV",
-		"TSVRaw",
-		"TSVWithNames",
-		"TSVWithNamesAndTypes",
-		"Values",
-		formatVertical,
-		"VerticalRaw",
-		"XML",
-
-		"Array",
-		"Boolean",
-		"Date",
-		"DateTime",
-		"Enum",
-		"Expression",
-		"FixedString",
-		"Float32",
-		"Float64",
-		"Int8",
-		"Int16",
-		"Int32",
-		"Int64",
-		"Nullable",
-		"Set",
-		"String",
-		"Tuple",
-		"UInt8",
-		"UInt16",
-		"UInt32",
-		"UInt64",
-	}
-
-	query := `
-	 SELECT concat('dictGet', t, '(\'', name, '\',\'', n,'\',' ,replaceRegexpAll(key,'([A-Za-z0-9]+)','to\\1(id)'), ')') as n2
+// used by the highlighter: SQL keywords (upper case) and names of the functions (lower case)
+var sqlKeywords map[string]bool
+var sqlFunctions map[string]bool
+
+func isSQLKeyword(word string) bool {
+	autocompleteMutex.RLock()
+	defer autocompleteMutex.RUnlock()
+	return sqlKeywords[strings.ToUpper(word)]
+}
+
+func isSQLFunction(word string) bool {
+	autocompleteMutex.RLock()
+	defer autocompleteMutex.RUnlock()
+	return sqlFunctions[strings.ToLower(word)]
+}
+
+// built-in lists, used when the server doesn't provide them (system.keywords, system.formats etc.)
+var builtinKeywords = []string{
+	"ADD COLUMN",
+	"AFTER",
+	"ALL",
+	"ALTER TABLE",
+	"AND",
+	"ANY",
+	"ARRAY",
+	"ARRAY JOIN",
+	"AS",
+	"ASC",
+	"ASYNC",
+	"ATTACH PART",
+	"ATTACH PARTITION",
+	"ATTACH",
+	"BETWEEN",
+	"BY",
+	"CASE",
+	"CHECK TABLE",
+	"CLEAR COLUMN",
+	"COLLATE",
+	"COORDINATE",
+	"COPY",
+	"CREATE",
+	"CROSS",
+	"DATABASE",
+	"DATABASES",
+	"DEDUPLICATE",
+	"DESC",
+	"DESCRIBE",
+	"DESCRIBE TABLE",
+	"DETACH",
+	"DETACH PARTITION",
+	"DISTINCT",
+	"DROP",
+	"DROP COLUMN",
+	"DROP PARTITION",
+	"ELSE",
+	"END",
+	"ENGINE",
+	"EXISTS",
+	"EXISTS TABLE",
+	"FETCH PARTITION",
+	"FINAL",
+	"FORMAT",
+	"FREEZE PARTITION",
+	"FROM",
+	"FULL",
+	"GROUP BY",
+	"GLOBAL",
+	"HAVING",
+	"IF EXISTS",
+	"IF NOT EXISTS",
+	"IN PARTITION",
+	"INNER",
+	"INSERT INTO",
+	"INTERVAL",
+	"INTO",
+	"IS NOT NULL",
+	"IS NULL",
+	"JOIN",
+	"KILL QUERY",
+	"LEFT",
+	"LEFT ARRAY JOIN",
+	"LIKE",
+	"LIMIT",
+	"LOCAL",
+	"MATERIALIZED",
+	"MODIFY COLUMN",
+	"MODIFY PRIMARY KEY",
+	"NAME",
+	"NOT",
+	"NULL",
+	"OFFSET",
+	"ON",
+	"OPTIMIZE TABLE",
+	"OR",
+	"ORDER",
+	"ORDER BY",
+	"OUTFILE",
+	"PARTITION",
+	"POPULATE",
+	"PREWHERE",
+	"RENAME TABLE",
+	//		"RESHARD",
+	"RIGHT",
+	"SELECT",
+	"SHOW",
+	"SET",
+	"SETTINGS",
+	"SAMPLE",
+	"SHOW CREATE TABLE",
+	"SHOW PROCESSLIST",
+	"SYNC",
+	"TABLE",
+	"TABLES",
+	"TEMPORARY",
+	"TEST",
+	"THEN",
+	"TO",
+	"TOTALS",
+	"UNION",
+	"UNION ALL",
+	"USE",
+	"USING",
+	"VALUES",
+	"VIEW",
+	"WHEN",
+	"WHERE",
+	"WITH",
+}
+
+var builtinEngines = []string{
+	"AggregatingMergeTree",
+	"Buffer",
+	"CollapsingMergeTree",
+	"Distributed",
+	"File",
+	"Join",
+	"Kafka",
+	"Log",
+	"MaterializedView",
+	"Memory",
+	"Merge",
+	"MergeTree",
+	"Null",
+	"ReplacingMergeTree",
+	"ReplicatedAggregatingMergeTree",
+	"ReplicatedCollapsingMergeTree",
+	"ReplicatedMergeTree",
+	"ReplicatedReplacingMergeTree",
+	"ReplicatedSummingMergeTree",
+	"Set",
+	"SummingMergeTree",
+	"TinyLog",
+	"View",
+}
+
+var builtinFormats = []string{
+	// https://github.com/yandex/ClickHouse/blob/master/dbms/src/DataStreams/FormatFactory.cpp
+	"BlockTabSeparated",
+	"CapnProto",
+	"CSV",
+	"CSVWithNames",
+	"JSON",
+	"JSONCompact",
+	"JSONEachRow",
+	"Native",
+	"Null",
+	"ODBCDriver",
+	"Pretty",
+	"PrettyCompact",
+	"PrettyCompactMonoBlock",
+	"PrettyCompactNoEscapes",
+	"PrettyNoEscapes",
+	"PrettySpace",
+	"PrettySpaceNoEscapes",
+	"RowBinary",
+	formatTabSeparated,
+	"TabSeparatedRaw",
+	"TabSeparatedWithNames",
+	"TabSeparatedWithNamesAndTypes",
+	"TSKV",
+	"TSV",
+	"TSVRaw",
+	"TSVWithNames",
+	"TSVWithNamesAndTypes",
+	"Values",
+	formatVertical,
+	"VerticalRaw",
+	"XML",
+}
+
+var builtinTypes = []string{
+	"Array",
+	"Boolean",
+	"Date",
+	"DateTime",
+	"Enum",
+	"Expression",
+	"FixedString",
+	"Float32",
+	"Float64",
+	"Int8",
+	"Int16",
+	"Int32",
+	"Int64",
+	"Nullable",
+	"Set",
+	"String",
+	"Tuple",
+	"UInt8",
+	"UInt16",
+	"UInt32",
+	"UInt64",
+}
+
+const autocompleteQuery = `
+	 SELECT concat('dictGet', t, '(\'', name, '\',\'', n,'\',' ,replaceRegexpAll(key,'([A-Za-z0-9]+)','to\\1(id)'), ')') as n2, 'dictionary', '', ''
 	 FROM system.dictionaries ARRAY JOIN attribute.names as n, attribute.types as t
 	 UNION ALL
-	 SELECT DISTINCT name FROM (
-		SELECT name FROM system.functions
+	 SELECT DISTINCT name, kind, db, tbl FROM (
+		SELECT name, 'function' AS kind, '' AS db, '' AS tbl FROM system.functions
 		UNION ALL
-		SELECT concat(name,'If') FROM system.functions WHERE is_aggregate=1
+		SELECT concat(name,'If'), 'function', '', '' FROM system.functions WHERE is_aggregate=1
 		UNION ALL
-		SELECT concat(name,'Array') FROM system.functions WHERE is_aggregate=1
+		SELECT concat(name,'Array'), 'function', '', '' FROM system.functions WHERE is_aggregate=1
 		UNION ALL
-		SELECT concat(name,'Merge') FROM system.functions WHERE is_aggregate=1
+		SELECT concat(name,'Merge'), 'function', '', '' FROM system.functions WHERE is_aggregate=1
 		UNION ALL
-		SELECT concat(name,'State') FROM system.functions WHERE is_aggregate=1
+		SELECT concat(name,'State'), 'function', '', '' FROM system.functions WHERE is_aggregate=1
 		UNION ALL
-		SELECT concat(name,'MergeState') FROM system.functions WHERE is_aggregate=1
+		SELECT concat(name,'MergeState'), 'function', '', '' FROM system.functions WHERE is_aggregate=1
 		UNION ALL
-		SELECT name FROM system.tables
+		SELECT name, 'table', database, '' FROM system.tables
 		UNION ALL
-		SELECT name FROM system.columns
+		SELECT name, 'column', database, table FROM system.columns WHERE database = currentDatabase()
 		UNION ALL
-		SELECT name FROM system.databases
+		SELECT name, 'database', '', '' FROM system.databases
 		UNION ALL
-		SELECT name FROM system.settings
+		SELECT name, 'setting', '', '' FROM system.settings
 	) ORDER BY name`
 
-	data, err := serviceRequest(query)
+// tables and columns of one database (%[1]s), and the list of databases, for the refresh after DDL queries
+const autocompleteDatabaseQuery = `
+	SELECT name, 'table', database, '' FROM system.tables WHERE database = %[1]s
+	UNION ALL
+	SELECT name, 'column', database, table FROM system.columns WHERE database = %[1]s
+	UNION ALL
+	SELECT name, 'database', '', '' FROM system.databases`
+
+// the data is replaced when the names are loaded in background, while it can be used by the prompt
+var autocompleteMutex sync.RWMutex
+
+// rows of autocompleteQuery the completion data is built from, they are cached on disk
+var autocompleteRows [][]string
+
+// columns are loaded for the current database at the start, for the other databases - when the completion
+// needs them. Failed loads are not repeated till the names are reloaded
+var columnsRequested = make(map[string]bool)
+
+// function signatures, system.functions has them only in new versions
+const autocompleteSignaturesQuery = `SELECT name, 'signature', syntax, '' FROM system.functions WHERE syntax != ''`
+
+// lists which replace the built-in ones (and the combinators for the aggregate functions), if the server has the table
+var autocompleteSystemLists = []struct {
+	table string
+	query string
+}{
+	{"keywords", "SELECT keyword, 'keyword', '', '' FROM system.keywords"},
+	{"formats", "SELECT name, 'format', '', '' FROM system.formats"},
+	{"table_engines", "SELECT name, 'engine', '', '' FROM system.table_engines"},
+	{"data_type_families", "SELECT name, 'type', '', '' FROM system.data_type_families"},
+	{"table_functions", "SELECT name, 'table function', '', '' FROM system.table_functions"},
+	{"aggregate_function_combinators", `SELECT concat(f.name, c.name), 'function', '', ''
+		FROM system.functions AS f CROSS JOIN system.aggregate_function_combinators AS c WHERE f.is_aggregate`},
+}
+
+// old servers don't have some of the tables, then built-in lists are used
+func loadSystemLists() [][]string {
+	extraSettings := map[string]string{"log_queries": "0"}
+	tables, err := serviceRequestWithExtraSetting("SELECT name FROM system.tables WHERE database = 'system'", extraSettings, opts.ACTimeout)
+	if err != nil {
+		return nil
+	}
+	available := make(map[string]bool)
+	for _, row := range tables {
+		available[row[0]] = true
+	}
+
+	var queries []string
+	for _, list := range autocompleteSystemLists {
+		if available[list.table] {
+			queries = append(queries, list.query)
+		}
+	}
+	if len(queries) == 0 {
+		return nil
+	}
+	rows, err := serviceRequestWithExtraSetting(strings.Join(queries, "\nUNION ALL\n"), extraSettings, opts.ACTimeout)
+	if err != nil {
+		return nil
+	}
+	return rows
+}
+
+// loads the names from the server and waits for them (\#)
+func initAutocomlete() error {
+	rows, err := serviceRequestWithExtraSetting(autocompleteQuery, map[string]string{"log_queries": "0"}, opts.ACTimeout)
+	if err != nil {
+		return err
+	}
+	if signatures, err := serviceRequestWithExtraSetting(autocompleteSignaturesQuery, map[string]string{"log_queries": "0"}, opts.ACTimeout); err == nil {
+		rows = append(rows, signatures...)
+	}
+	rows = append(rows, loadSystemLists()...)
+
+	autocompleteMutex.Lock()
+	columnsRequested = make(map[string]bool)
+	setAutocompleteRowsLocked(rows)
+	autocompleteMutex.Unlock()
+	saveAutocompleteCache(rows)
+	return nil
+}
+
+// completion works right away with built-in lists and cached names, the fresh names are loaded in background
+func initAutocomleteInBackground() {
+	setAutocompleteRows(loadAutocompleteCache())
+	go initAutocomlete()
+	go loadCompletionUsage(historyFn)
+}
+
+func setAutocompleteRows(rows [][]string) {
+	autocompleteMutex.Lock()
+	defer autocompleteMutex.Unlock()
+	setAutocompleteRowsLocked(rows)
+}
+
+// autocompleteMutex should be locked for writing
+func setAutocompleteRowsLocked(rows [][]string) {
+	var keywords []completionCandidate
+	seen := make(map[string]bool)
+	addKeyword := func(name, kind string) {
+		// the same column name can be in many tables
+		if !seen[name] {
+			seen[name] = true
+			keywords = append(keywords, completionCandidate{Name: name, Kind: kind})
+		}
+	}
+
+	// lists from the server replace the built-in ones
+	listKinds := []string{"keyword", "engine", "format", "type"}
+	lists := map[string][]string{"keyword": builtinKeywords, "engine": builtinEngines, "format": builtinFormats, "type": builtinTypes}
+	serverLists := make(map[string][]string)
+	for _, element := range rows {
+		if len(element) >= 4 {
+			if _, ok := lists[element[1]]; ok {
+				serverLists[element[1]] = append(serverLists[element[1]], element[0])
+			}
+		}
+	}
+	for kind, names := range serverLists {
+		sort.Strings(names)
+		lists[kind] = names
+	}
+	for _, kind := range listKinds {
+		for _, name := range lists[kind] {
+			addKeyword(name, kind)
+		}
+	}
+
+	keywordSet := make(map[string]bool)
+	for _, keyword := range lists["keyword"] {
+		for _, word := range strings.Fields(keyword) {
+			keywordSet[strings.ToUpper(word)] = true
+		}
+	}
+
+	functionSet := make(map[string]bool)
+	meta := completionMetadata{formats: lists["format"], tables: make(map[string][]string), columns: make(map[string][]string), columnDatabases: make(map[string]bool), signatures: make(map[string]string)}
+	for _, element := range rows {
+		if len(element) < 4 {
+			continue
+		}
+		name, kind, database, table := element[0], element[1], element[2], element[3]
+		switch kind {
+		case "function", "dictionary":
+			functionSet[strings.ToLower(name)] = true
+			meta.functions = append(meta.functions, name)
+		case "table":
+			meta.tables[database] = append(meta.tables[database], name)
+		case "column":
+			meta.columns[database+"."+table] = append(meta.columns[database+"."+table], name)
+			meta.columnDatabases[database] = true
+		case "database":
+			meta.databases = append(meta.databases, name)
+		case "setting":
+			meta.settings = append(meta.settings, name)
+		case "table function":
+			meta.tableFunctions = append(meta.tableFunctions, name)
+		case "keyword", "engine", "format", "type":
+			continue
+		case "signature":
+			meta.signatures[strings.ToLower(name)] = database // the text of the signature is in the third column
+			continue
+		}
+		addKeyword(name, kind)
+	}
+	meta.keywords = keywords
+
+	autocompleteRows = rows
+	completionMeta = meta
+	sqlKeywords = keywordSet
+	sqlFunctions = functionSet
+}
+
+var ddlRegexp = regexp.MustCompile("(?i)^\\s*(?:CREATE|DROP|ATTACH|DETACH|ALTER|RENAME)\\s+(?:OR\\s+REPLACE\\s+)?(?:TEMPORARY\\s+)?(?:MATERIALIZED\\s+|LIVE\\s+)?(TABLE|VIEW|DICTIONARY|DATABASE)\\s+(?:IF\\s+(?:NOT\\s+)?EXISTS\\s+)?([\\w\"`]+)(?:\\s*\\.\\s*([\\w\"`]+))?")
+
+// reloads the names of the database changed by the successful query (USE, CREATE, DROP etc.) in background
+func refreshAutocomplete(query string) {
+	var database string
+	if useCmdRegexp.MatchString(query) {
+		database = opts.Database
+	} else if matches := ddlRegexp.FindStringSubmatch(query); matches != nil {
+		switch {
+		case strings.ToUpper(matches[1]) == "DATABASE", len(matches[3]) > 0:
+			database = unquoteIdentifier(matches[2])
+		default:
+			database = opts.Database
+		}
+	} else {
+		return
+	}
+	go refreshAutocompleteDatabase(database)
+}
+
+func refreshAutocompleteDatabase(database string) {
+	query := fmt.Sprintf(autocompleteDatabaseQuery, quoteString(database))
+	rows, err := serviceRequestWithExtraSetting(query, map[string]string{"log_queries": "0"}, opts.ACTimeout)
 	if err != nil {
-		keywordsAutocomlete = keywords
-		log.Println(err)
+		return
+	}
+
+	// the rows can be replaced by another refresh meanwhile
+	autocompleteMutex.Lock()
+	for _, row := range autocompleteRows {
+		if len(row) < 4 || row[1] == "database" || ((row[1] == "table" || row[1] == "column") && row[2] == database) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+	setAutocompleteRowsLocked(rows)
+	autocompleteMutex.Unlock()
+	saveAutocompleteCache(rows)
+}
+
+// names of the objects on the server by kind, for context-aware completion
+type completionMetadata struct {
+	keywords        []completionCandidate // everything, for the completion without context
+	databases       []string
+	tables          map[string][]string // by database
+	columns         map[string][]string // by database.table
+	columnDatabases map[string]bool     // databases with loaded columns
+	functions       []string
+	tableFunctions  []string
+	signatures      map[string]string // by lower case function name
+	settings        []string
+	formats         []string
+}
+
+var completionMeta completionMetadata
+
+func currentCompletionMeta() completionMetadata {
+	autocompleteMutex.RLock()
+	defer autocompleteMutex.RUnlock()
+	return completionMeta
+}
+
+// returns the candidates for the word before the cursor (byte offset in the text) and the offset where the word starts
+func clickhouseComleter(text string, cursor int) (start int, c []completionCandidate) {
+	allTokens := tokenizeSQL(text[:cursor])
+	// no completion inside literals and comments
+	if last := lastToken(allTokens); last != nil && (last.Unterminated || strings.HasPrefix(last.Text, "--")) {
+		return
+	}
+
+	var tokens []sqlToken
+	for _, token := range allTokens {
+		switch token.Kind {
+		case tokenSemicolon:
+			tokens = tokens[:0]
+		case tokenWhitespace, tokenComment:
+		default:
+			tokens = append(tokens, token)
+		}
+	}
+
+	start = cursor
+	word := ""
+	if last := len(tokens) - 1; last >= 0 && tokens[last].End == cursor && tokens[last].Kind == tokenBareWord {
+		start, word = tokens[last].Start, tokens[last].Text
+		tokens = tokens[:last]
+	}
+
+	meta := currentCompletionMeta()
+	var candidates []completionCandidate
+	// candidates of the groups added first are ranked higher
+	group := 0
+	add := func(kind string, names []string) {
+		for _, name := range names {
+			candidates = append(candidates, completionCandidate{Name: name, Kind: kind, rank: group})
+		}
+		group++
+	}
+	addGeneral := func() {
+		currentTables := make(map[string]bool)
+		for _, table := range meta.tables[opts.Database] {
+			currentTables[table] = true
+		}
+		for _, candidate := range meta.keywords {
+			candidate.rank = group + generalKindRank(candidate, currentTables)
+			candidates = append(candidates, candidate)
+		}
+	}
+	prev := func(idx int) string {
+		if idx < len(tokens) {
+			return strings.ToUpper(tokens[len(tokens)-1-idx].Text)
+		}
+		return ""
+	}
+	switch {
+	case prev(0) == "." && len(tokens) > 1 && isIdentifierToken(tokens[len(tokens)-2]):
+		qualifier := unquoteIdentifier(tokens[len(tokens)-2].Text)
+		if tables, ok := meta.tables[qualifier]; ok {
+			add("table", tables)
+		} else {
+			for _, ref := range tableReferences(currentStatementTokens(text, cursor)) {
+				if ref.Alias == qualifier || ref.Table == qualifier {
+					add("column", tableColumns(meta, ref))
+				}
+			}
+		}
+	case word == "" && prev(0) == "":
+		return
+	case isTableContextKeyword(prev(0)):
+		add("table", meta.tables[opts.Database])
+		var qualified []string
+		for _, database := range meta.databases {
+			for _, table := range meta.tables[database] {
+				qualified = append(qualified, database+"."+table)
+			}
+		}
+		add("table", qualified)
+		add("table function", meta.tableFunctions)
+	case prev(0) == "USE" || prev(0) == "DATABASE":
+		add("database", meta.databases)
+	case prev(0) == "FORMAT":
+		add("format", meta.formats)
+	case isSettingsContext(tokens):
+		add("setting", meta.settings)
+	case isColumnsContext(tokens):
+		for _, ref := range tableReferences(currentStatementTokens(text, cursor)) {
+			add("column", tableColumns(meta, ref))
+		}
+		add("function", meta.functions)
+		addGeneral()
+	default:
+		if word == "" {
+			return
+		}
+		addGeneral()
+	}
+
+	c = rankCandidates(word, candidates)
+	for idx := range c {
+		if c[idx].Kind == "function" {
+			c[idx].Signature = meta.signatures[strings.ToLower(c[idx].Name)]
+		}
+	}
+	return
+}
+
+func lastToken(tokens []sqlToken) *sqlToken {
+	if len(tokens) == 0 {
+		return nil
+	}
+	return &tokens[len(tokens)-1]
+}
+
+func isIdentifierToken(token sqlToken) bool {
+	return token.Kind == tokenBareWord || token.Kind == tokenQuotedIdentifier
+}
+
+func unquoteIdentifier(name string) string {
+	return strings.Trim(name, "\"`")
+}
+
+func isTableContextKeyword(keyword string) bool {
+	switch keyword {
+	case "FROM", "JOIN", "INTO", "TABLE", "DESCRIBE", "DESC", "EXISTS":
+		return true
+	}
+	return false
+}
+
+// the keyword which starts the clause the cursor is in, the content of the brackets before the cursor is skipped
+func currentClause(tokens []sqlToken) string {
+	depth := 0
+	for idx := len(tokens) - 1; idx >= 0; idx-- {
+		switch tokens[idx].Kind {
+		case tokenClosingBracket:
+			depth++
+		case tokenOpeningBracket:
+			if depth > 0 {
+				depth--
+			}
+		case tokenBareWord:
+			if depth > 0 {
+				continue
+			}
+			switch keyword := strings.ToUpper(tokens[idx].Text); keyword {
+			case "SELECT", "FROM", "JOIN", "WHERE", "PREWHERE", "BY", "HAVING", "ON", "USING", "LIMIT",
+				"SETTINGS", "SET", "FORMAT", "INTO", "VALUES":
+				return keyword
+			}
+		}
 	}
+	return ""
+}
 
-	for _, element := range data {
-		keywords = append(keywords, element[0])
+// SETTINGS name = value, name2 = value2
+func isSettingsContext(tokens []sqlToken) bool {
+	if len(tokens) == 0 {
+		return false
 	}
+	switch strings.ToUpper(tokens[len(tokens)-1].Text) {
+	case "SETTINGS", "SET":
+		return true
+	case ",":
+		clause := currentClause(tokens)
+		return clause == "SETTINGS" || clause == "SET"
+	}
+	return false
+}
 
-	keywordsAutocomlete = keywords
-	//	spew.Dump(keywordsAutocomlete)
+func isColumnsContext(tokens []sqlToken) bool {
+	switch currentClause(tokens) {
+	case "SELECT", "WHERE", "PREWHERE", "BY", "HAVING", "ON", "USING":
+		return true
+	}
+	return false
 }
 
-var lastWordRegexp = regexp.MustCompile("(^.*)\\b(\\w+)$")
+// meaningful tokens of the statement the cursor is in (including the part after the cursor)
+func currentStatementTokens(text string, cursor int) (tokens []sqlToken) {
+	for _, token := range tokenizeSQL(text) {
+		switch {
+		case token.Kind == tokenSemicolon && token.End <= cursor:
+			tokens = tokens[:0]
+		case token.Kind == tokenSemicolon:
+			return
+		case token.Kind != tokenWhitespace && token.Kind != tokenComment:
+			tokens = append(tokens, token)
+		}
+	}
+	return
+}
 
-func clickhouseComleter(line string) (c []string) {
-	matches := lastWordRegexp.FindStringSubmatch(line)
-	if len(matches) == 3 {
-		lastWord := matches[2]
-		prefix := matches[1]
-		for _, n := range keywordsAutocomlete {
-			// possible improvements:
-			//  sort keywords by popularity
-			//  make it context aware (?)
-			//  use more effective search (like binary tree) than simple iterations through all the keywords
-			if strings.HasPrefix(strings.ToLower(n), strings.ToLower(lastWord)) {
-				c = append(c, prefix+n)
+type tableReference struct {
+	Database string
+	Table    string
+	Alias    string
+}
+
+// tables after FROM and JOIN: [db.]table [[AS] alias] [, ...], table functions and subqueries are skipped
+func tableReferences(tokens []sqlToken) (refs []tableReference) {
+	for idx := 0; idx < len(tokens); idx++ {
+		if keyword := strings.ToUpper(tokens[idx].Text); keyword != "FROM" && keyword != "JOIN" {
+			continue
+		}
+		for idx+1 < len(tokens) && isIdentifierToken(tokens[idx+1]) {
+			idx++
+			ref := tableReference{Table: unquoteIdentifier(tokens[idx].Text)}
+			if idx+2 < len(tokens) && tokens[idx+1].Text == "." && isIdentifierToken(tokens[idx+2]) {
+				ref.Database, ref.Table = ref.Table, unquoteIdentifier(tokens[idx+2].Text)
+				idx += 2
 			}
+			if idx+1 < len(tokens) && tokens[idx+1].Text == "(" {
+				break
+			}
+			if idx+2 < len(tokens) && strings.ToUpper(tokens[idx+1].Text) == "AS" && isIdentifierToken(tokens[idx+2]) {
+				ref.Alias = unquoteIdentifier(tokens[idx+2].Text)
+				idx += 2
+			} else if idx+1 < len(tokens) && isIdentifierToken(tokens[idx+1]) && !isSQLKeyword(tokens[idx+1].Text) {
+				ref.Alias = unquoteIdentifier(tokens[idx+1].Text)
+				idx++
+			}
+			refs = append(refs, ref)
+			if idx+1 >= len(tokens) || tokens[idx+1].Text != "," {
+				break
+			}
+			idx++
 		}
 	}
 	return
 }
+
+func tableColumns(meta completionMetadata, ref tableReference) []string {
+	database := ref.Database
+	if len(database) == 0 {
+		database = opts.Database
+	}
+	// loaded in background, the next Tab gets them
+	if !meta.columnDatabases[database] && len(meta.tables[database]) > 0 && requestColumns(database) {
+		go refreshAutocompleteDatabase(database)
+	}
+	return meta.columns[database+"."+ref.Table]
+}
+
+// true only for the first request of the database
+func requestColumns(database string) bool {
+	autocompleteMutex.Lock()
+	defer autocompleteMutex.Unlock()
+	if columnsRequested[database] {
+		return false
+	}
+	columnsRequested[database] = true
+	return true
+}
+
+// readline can only append the rest of the candidate to the word under the cursor (so "sel" would become "selECT"),
+// that's why candidates are inserted by the listener, which can replace the line. Tab cycles through the candidates,
+// the first Tab prints the menu with the best of them, Shift-Tab goes back.
+type lineCompleter struct {
+	previousLines string    // lines of the statement entered before, the context of the completion
+	menu          io.Writer // readline instance, which redraws the prompt after the output
+	candidates    []string
+	current       int
+	head          string // the line before the cursor with inserted candidate, Tab after it continues the cycle
+	tail          []rune // the part of the line after the cursor
+	backward      bool   // set by Shift-Tab
+}
+
+// readline.AutoCompleter, it's called on Tab before the listener
+func (c *lineCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	return nil, 0
+}
+
+// readline.Listener
+func (c *lineCompleter) OnChange(line []rune, pos int, key rune) ([]rune, int, bool) {
+	backward := c.backward
+	c.backward = false
+	if key != readline.CharTab {
+		c.candidates = nil
+		return nil, 0, false
+	}
+	if c.candidates == nil || string(line[:pos]) != c.head {
+		head := string(line[:pos])
+		start, found := clickhouseComleter(c.previousLines+head+string(line[pos:]), len(c.previousLines)+len(head))
+		start -= len(c.previousLines)
+		if start < 0 {
+			return nil, 0, false
+		}
+		c.candidates = nil
+		for _, candidate := range found {
+			c.candidates = append(c.candidates, head[:start]+candidate.Name)
+		}
+		c.current = -1
+		c.tail = append([]rune(nil), line[pos:]...)
+		if len(found) > 1 && c.menu != nil {
+			io.WriteString(c.menu, completionMenu(found))
+		}
+	}
+	if len(c.candidates) == 0 {
+		return nil, 0, false
+	}
+	switch {
+	case !backward:
+		c.current = (c.current + 1) % len(c.candidates)
+	case c.current < 0:
+		c.current = len(c.candidates) - 1
+	default:
+		c.current = (c.current + len(c.candidates) - 1) % len(c.candidates)
+	}
+	c.head = c.candidates[c.current]
+	head := []rune(c.head)
+	return append(head, c.tail...), len(head), true
+}
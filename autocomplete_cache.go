@@ -0,0 +1,65 @@
+package main
+
+// Names for autocompletion are cached in ~/.chc/autocomplete, so the completion works right after the start
+// even if loading them takes long. The cache is per server (host, port, user) and its version.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+var autocompleteCacheDir = filepath.Join(homedir(), ".chc", "autocomplete")
+
+var cacheFileNameRegexp = regexp.MustCompile("[^\\w.-]+")
+
+// empty if the server version is unknown
+func autocompleteCacheFile() string {
+	if len(serverVersion) == 0 {
+		return ""
+	}
+	name := fmt.Sprintf("%s_%d_%s_%s.json", opts.Host, opts.Port, opts.User, serverVersion)
+	return filepath.Join(autocompleteCacheDir, cacheFileNameRegexp.ReplaceAllString(name, "_"))
+}
+
+func loadAutocompleteCache() (rows [][]string) {
+	fileName := autocompleteCacheFile()
+	if len(fileName) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil
+	}
+	if err = json.Unmarshal(data, &rows); err != nil {
+		return nil
+	}
+	return rows
+}
+
+// errors are ignored, without the cache the completion just starts working a bit later
+func saveAutocompleteCache(rows [][]string) {
+	fileName := autocompleteCacheFile()
+	if len(fileName) == 0 {
+		return
+	}
+	data, err := json.Marshal(rows)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(autocompleteCacheDir, 0700); err != nil {
+		return
+	}
+	// several chc processes can write the same file
+	tmpFileName := fileName + "." + strconv.Itoa(os.Getpid())
+	if err = ioutil.WriteFile(tmpFileName, data, 0600); err != nil {
+		return
+	}
+	if err = os.Rename(tmpFileName, fileName); err != nil {
+		os.Remove(tmpFileName)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+// Ranking of completion candidates: prefix matches go first, then fuzzy ones (the typed letters are found in the
+// name in the same order, like uniqcomb -> uniqCombined). Inside that the candidates suitable for the context
+// and the names used more often in the history are preferred.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mattn/go-runewidth"
+)
+
+type completionCandidate struct {
+	Name      string
+	Kind      string // keyword, function, table, column etc.
+	Signature string // for functions, if the server provides it
+	rank      int    // group of the candidate in the current context, lower is better
+}
+
+const (
+	matchScoreExactPrefix = 300
+	matchScorePrefix      = 280 // case differs
+	matchScoreFuzzy       = 200 // minus the number of skipped letters
+	rankPenalty           = 10
+	usageBonus            = 5
+	maxUsageCounted       = 10
+)
+
+// returns -1 if the name doesn't match the typed word
+func fuzzyMatchScore(word, name string) int {
+	if len(word) == 0 {
+		return 0
+	}
+	if strings.HasPrefix(name, word) {
+		return matchScoreExactPrefix
+	}
+	lowerWord, lowerName := []rune(strings.ToLower(word)), []rune(strings.ToLower(name))
+	if strings.HasPrefix(string(lowerName), string(lowerWord)) {
+		return matchScorePrefix
+	}
+	// the first letter should match, otherwise too many names are suggested
+	if len(lowerName) == 0 || lowerName[0] != lowerWord[0] {
+		return -1
+	}
+	matched, skipped := 0, 0
+	for _, r := range lowerName {
+		if matched == len(lowerWord) {
+			break
+		}
+		if r == lowerWord[matched] {
+			matched++
+		} else {
+			skipped++
+		}
+	}
+	if matched < len(lowerWord) {
+		return -1
+	}
+	if skipped >= matchScoreFuzzy {
+		return 1
+	}
+	return matchScoreFuzzy - skipped
+}
+
+// keywords first, then tables of the current database, columns and functions
+func generalKindRank(candidate completionCandidate, currentTables map[string]bool) int {
+	switch candidate.Kind {
+	case "keyword":
+		return 0
+	case "table":
+		if currentTables[candidate.Name] {
+			return 1
+		}
+	case "column":
+		return 2
+	case "function", "dictionary":
+		return 3
+	}
+	return 4
+}
+
+// filters the candidates matching the word, removes duplicates (the best ranked one is kept) and sorts them
+func rankCandidates(word string, candidates []completionCandidate) []completionCandidate {
+	type scored struct {
+		completionCandidate
+		score int
+	}
+	var matched []scored
+	byName := make(map[string]int)
+	usageCounts := completionUsageSnapshot()
+	for _, candidate := range candidates {
+		score := fuzzyMatchScore(word, candidate.Name)
+		if score < 0 {
+			continue
+		}
+		usage := usageCounts[strings.ToLower(candidate.Name)]
+		if usage > maxUsageCounted {
+			usage = maxUsageCounted
+		}
+		score += usage*usageBonus - candidate.rank*rankPenalty
+		if idx, ok := byName[candidate.Name]; ok {
+			if score > matched[idx].score {
+				matched[idx] = scored{candidate, score}
+			}
+			continue
+		}
+		byName[candidate.Name] = len(matched)
+		matched = append(matched, scored{candidate, score})
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].score > matched[j].score })
+	result := make([]completionCandidate, len(matched))
+	for idx := range matched {
+		result[idx] = matched[idx].completionCandidate
+	}
+	return result
+}
+
+// how many times the name was used in the queries, by lower case name (guarded by autocompleteMutex)
+var completionUsage = make(map[string]int)
+
+// a copy, so the lock is taken once for all the candidates
+func completionUsageSnapshot() map[string]int {
+	autocompleteMutex.RLock()
+	defer autocompleteMutex.RUnlock()
+	snapshot := make(map[string]int, len(completionUsage))
+	for name, count := range completionUsage {
+		snapshot[name] = count
+	}
+	return snapshot
+}
+
+func countCompletionUsage(query string) {
+	autocompleteMutex.Lock()
+	defer autocompleteMutex.Unlock()
+	for _, token := range tokenizeSQL(query) {
+		if token.Kind == tokenBareWord || token.Kind == tokenQuotedIdentifier {
+			completionUsage[strings.ToLower(unquoteIdentifier(token.Text))]++
+		}
+	}
+}
+
+func loadCompletionUsage(historyFile string) {
+	f, err := os.Open(historyFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		countCompletionUsage(scanner.Text())
+	}
+}
+
+const completionMenuSize = 10
+const completionSignatureWidth = 60
+
+// the best candidates with their kinds and signatures of the functions
+func completionMenu(candidates []completionCandidate) string {
+	shown := candidates
+	if len(shown) > completionMenuSize {
+		shown = shown[:completionMenuSize]
+	}
+	nameWidth := 0
+	for _, candidate := range shown {
+		if w := runewidth.StringWidth(candidate.Name); w > nameWidth {
+			nameWidth = w
+		}
+	}
+
+	var sb strings.Builder
+	for _, candidate := range shown {
+		signature := strings.TrimSpace(strings.SplitN(candidate.Signature, "\n", 2)[0])
+		signature = runewidth.Truncate(signature, completionSignatureWidth, "…")
+		line := fmt.Sprintf("  %s%s  %-10s %s", candidate.Name, strings.Repeat(" ", nameWidth-runewidth.StringWidth(candidate.Name)), candidate.Kind, signature)
+		sb.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+	if len(candidates) > len(shown) {
+		sb.WriteString(fmt.Sprintf("  ... and %d more (Tab cycles through all of them)\n", len(candidates)-len(shown)))
+	}
+	return sb.String()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFuzzyMatchScore(t *testing.T) {
+	tests := []struct {
+		word, name string
+		want       int
+	}{
+		{"", "anything", 0},
+		{"uniq", "uniqExact", matchScoreExactPrefix},
+		{"UNIQ", "uniqExact", matchScorePrefix},
+		{"uniqcomb", "uniqCombined", matchScorePrefix},
+		{"uqc", "uniqCombined", matchScoreFuzzy - 2},
+		{"ucmb", "uniqCombined", matchScoreFuzzy - 4},
+		{"qc", "uniqCombined", -1},
+		{"uniqx", "uniqCombined", -1},
+		{"ä", "Äpfel", matchScorePrefix},
+	}
+	for _, test := range tests {
+		if got := fuzzyMatchScore(test.word, test.name); got != test.want {
+			t.Errorf("fuzzyMatchScore(%q, %q) = %d, want %d", test.word, test.name, got, test.want)
+		}
+	}
+}
+
+func TestRankCandidates(t *testing.T) {
+	saved := completionUsage
+	defer func() { completionUsage = saved }()
+	completionUsage = map[string]int{"sumif": 3}
+
+	candidates := []completionCandidate{
+		{Name: "sumMap", Kind: "function", rank: 1},
+		{Name: "summary", Kind: "table", rank: 0},
+		{Name: "sumIf", Kind: "function", rank: 1},
+		{Name: "SUM", Kind: "function", rank: 1},
+		{Name: "sumMap", Kind: "column", rank: 0},
+		{Name: "count", Kind: "function", rank: 1},
+		{Name: "s_u_m", Kind: "column", rank: 0},
+	}
+	var names, kinds []string
+	for _, candidate := range rankCandidates("sum", candidates) {
+		names = append(names, candidate.Name)
+		kinds = append(kinds, candidate.Kind)
+	}
+	// equal scores keep the order of the candidates, the duplicate takes the place of the first one
+	wantNames := []string{"sumIf", "sumMap", "summary", "SUM", "s_u_m"}
+	wantKinds := []string{"function", "column", "table", "function", "column"}
+	if !reflect.DeepEqual(names, wantNames) || !reflect.DeepEqual(kinds, wantKinds) {
+		t.Errorf("rankCandidates = %q %q, want %q %q", names, kinds, wantNames, wantKinds)
+	}
+}
@@ -16,14 +16,8 @@ package main
 // https://github.com/rqlite/rqlite/blob/master/cmd/rqlite/main.go
 // https://github.com/cockroachdb/cockroach/blob/master/pkg/cli/start.go
 
-// TODO:
-// promptForPassword, password from env
-// configs?
-// multiline / multiquery mode
-// settings from command line
-// native protocol support
-
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -36,35 +30,55 @@ import (
 const (
 	formatTabSeparated = "TabSeparated"
 	formatVertical     = "Vertical"
+
+	protocolNative = "native"
 )
 
 var opts struct {
 	Help       bool   `long:"help"                                      description:"produce help message"`
-	Host       string `long:"host"       short:"h"  default:"localhost" description:"server host"`
+	Host       string `long:"host"       short:"h"  default:"localhost" description:"server host, or replicas: h1,h2:port"     env:"CLICKHOUSE_HOST"`
 	Port       uint   `long:"port"                  default:"8123"      description:"server port"`
-	Protocol   string `long:"protocol"              default:"http"      description:"protocol (http or https are supported)"`
-	User       string `long:"user"       short:"u"  default:"default"   description:"user"`
-	Password   string `long:"password"                                  description:"password"`
+	Protocol   string `long:"protocol"              default:"http"      description:"protocol (http, https or native are supported)"`
+	User       string `long:"user"       short:"u"  default:"default"   description:"user"                                     env:"CLICKHOUSE_USER"`
+	Password   string `long:"password"                                  description:"password"                                 env:"CLICKHOUSE_PASSWORD"`
+	AskPass    bool   `long:"ask-password"                              description:"ask password with echo disabled"`
 	Query      string `long:"query"      short:"q"                      description:"query"`
 	Database   string `long:"database"   short:"d"  default:"default"   description:"database"`
-	Pager      string `long:"pager"                                     description:"pager"`
-	Multiline  bool   `long:"multiline"  short:"m"                      description:"multiline"`
-	Multiquery bool   `long:"multiquery" short:"n"                      description:"multiquery"`
+	Pager      string `long:"pager"                                     description:"pager command, \"internal\" for built-in viewer,\nor \"auto\" to use it for results higher than\nthe screen"`
+	Multiline  bool   `long:"multiline"  short:"m"                      description:"multiline mode: Enter continues the query,\nit's executed after semicolon or \\G. Without\nit Enter executes the query, line ending\nwith backslash continues it"`
+	Multiquery bool   `long:"multiquery" short:"n"                      description:"multiquery mode: execute several\nsemicolon-separated queries from --query\nor stdin"`
 	Format     string `long:"format"     short:"f"                      description:"default output format"`
 	Vertical   bool   `long:"vertical"   short:"E"                      description:"vertical output format, same as\n--format=Vertical or FORMAT Vertical or\n\\G at end of command"`
-	Time       bool   `long:"time"       short:"t"                      description:"print query execution time to stderr in\nnon-interactive mode (for benchmarks)"`
+	Time       bool   `long:"time"       short:"t"                      description:"print query execution time to stderr in\nnon-interactive mode (for benchmarks): one\nline with seconds per query"`
 	Stacktrace bool   `long:"stacktrace"                                description:"print stack traces of exceptions"`
 	Progress   bool   `long:"progress"                                  description:"print progress even in non-interactive\nmode"`
 	Version    bool   `long:"version"    short:"V"                      description:"print version information and exit"`
 	Echo       bool   `long:"echo"                                      description:"in batch mode, print query before execution"`
+	IgnoreErr  bool   `long:"ignore-error"                              description:"in multiquery mode, don't stop processing\nif a query failed"`
+	StatsWait  uint   `long:"stats-wait"            default:"0"         description:"seconds to wait for query statistics in\nsystem.query_log when server doesn't send\nX-ClickHouse-Summary (0 - look it up once\nwithout waiting)"`
+	ConfigFile string `long:"config-file" short:"C"                     description:"config file (by default ~/.chc/config.yaml\nor ~/.clickhouse-client/config.xml)"`
+	Connection string `long:"connection"                                description:"use named connection from config file"`
+	ACTimeout  uint   `long:"autocomplete-timeout"  default:"30"        description:"seconds to wait for names for autocompletion,\nthey are loaded in background"`
+	Compress   string `long:"compression"                               description:"compression of http traffic: gzip, zstd, br,\nlz4 or none (default). Results are compressed\nby the server, data sent to INSERTs by chc"`
+	HostOrder  string `long:"host-order"            default:"in_order"  description:"order of connecting to the replicas:\nin_order or random" choice:"in_order" choice:"random"`
+	PinReplica bool   `long:"pin-replica"                               description:"when the connection is lost wait for the same\nreplica, as the session exists only on it"`
+
+	Settings []string `long:"setting"                description:"ClickHouse setting for all queries as\nkey=value, can be repeated. Settings can\nbe also passed as --max_threads=8, and\nquery parameters as --param_name=value"`
+
+	CACert        string `long:"ca-cert"                description:"file with CA certificates to verify the server (https)"`
+	ClientCert    string `long:"client-cert"            description:"client certificate file (https)"`
+	ClientKey     string `long:"client-key"             description:"client private key file (https)"`
+	TLSServerName string `long:"tls-server-name"        description:"server name to verify the certificate against\n(by default --host is used)"`
+	Insecure      bool   `long:"insecure"               description:"don't verify server certificate (https)"`
 }
 
+// settings changed with SET queries
 var clickhouseSetting = make(map[string]string)
 
 const versionString = "v0.1.6"
 
 func parseArgs() {
-	argsParser := flags.NewNamedParser("chc (ClickHouse CLI portable)", flags.Default&^flags.HelpFlag) // , HelpFlag
+	argsParser := flags.NewNamedParser("chc (ClickHouse CLI portable)", flags.Default&^flags.HelpFlag|flags.IgnoreUnknown) // , HelpFlag
 	argsParser.ShortDescription = "Unofficial portable ClickHouse CLI"
 	argsParser.LongDescription = "works with ClickHouse from MacOS/Windows/Linux without extra dependencies"
 	argsParser.AddGroup("Main Options", "Main Options", &opts)
@@ -84,51 +98,133 @@ func parseArgs() {
 		os.Exit(1)
 	}
 
-	if opts.Vertical && len(opts.Format) == 0 {
-		opts.Format = formatVertical
+	cfg, err := loadConfig(opts.ConfigFile)
+	if err != nil {
+		chcOutput.printServiceMsg("Unable to read config file: " + err.Error() + "\n")
+		os.Exit(1)
 	}
 
-	// if !opts.Multiline {
-	// 	chcOutput.printServiceMsg("Only multiline mode is currently supported\n")
-	// }
+	portIsDefault := argsParser.FindOptionByLongName("port").IsSetDefault()
+	if cfg != nil {
+		conn, err := cfg.connection(opts.Connection)
+		if err != nil {
+			chcOutput.printServiceMsg(err.Error() + "\n")
+			os.Exit(1)
+		}
+		if applyConnectionConfig(argsParser, conn) {
+			portIsDefault = false
+		}
+	} else if len(opts.Connection) > 0 {
+		chcOutput.printServiceMsg("Connection " + opts.Connection + " is specified, but there is no config file\n")
+		os.Exit(1)
+	}
 
-	if opts.Multiquery {
-		chcOutput.printServiceMsg("Multiquery mode is not supported yet\n")
+	// settings from command line override the ones from config file
+	for _, setting := range opts.Settings {
+		if !setQuerySetting(setting) {
+			chcOutput.printServiceMsg("Bad setting " + setting + ", should be key=value\n")
+			os.Exit(1)
+		}
+	}
+	if args, err = parseSettingArgs(args); err != nil {
+		chcOutput.printServiceMsg(err.Error() + "\n")
+		os.Exit(1)
+	}
+
+	if opts.Vertical && !isSetByUser(argsParser, "format") {
+		opts.Format = formatVertical
 	}
 
 	switch opts.Protocol {
 	case "https":
-		if argsParser.FindOptionByLongName("port").IsSetDefault() {
+		if portIsDefault {
 			opts.Port = 8443
 		}
 	case "http":
+	case protocolNative:
+		if portIsDefault {
+			opts.Port = 9000
+		}
 	default:
 		chcOutput.printServiceMsg("Protocol " + opts.Protocol + " is not supported.\n")
 		os.Exit(1)
 	}
 
+	if replicas, err = parseHosts(opts.Host, opts.Port); err != nil {
+		chcOutput.printServiceMsg(err.Error() + "\n")
+		os.Exit(1)
+	}
+
+	if opts.Compress, err = parseHTTPCompression(opts.Compress); err != nil {
+		chcOutput.printServiceMsg(err.Error() + "\n")
+		os.Exit(1)
+	}
+
+	if err = setupHTTPClient(); err != nil {
+		chcOutput.printServiceMsg("TLS configuration error: " + err.Error() + "\n")
+		os.Exit(1)
+	}
+
 	if len(args) > 0 {
 		chcOutput.printServiceMsg("Following arguments were ignored:" + strings.Join(args, " ") + "\n")
 	}
 }
 
-/// TODO - process settings
+// exit codes in batch mode, exception from the server gives its code (like in native client)
+const (
+	exitCodeClientError  = 1
+	exitCodeNetworkError = 210 // same as NETWORK_ERROR exception
+	exitCodeInterrupted  = 130 // killed with Ctrl+C, like shells do for SIGINT
+)
+
+func exitCode(err error) int {
+	if code := exceptionCode(err); code != 0 {
+		// only lower 8 bits of exit status are visible on *nix, and they should not become 0
+		if code%256 == 0 {
+			return exitCodeClientError
+		}
+		return code
+	}
+	switch {
+	case err == context.Canceled:
+		return exitCodeInterrupted
+	case isConnectionError(err):
+		return exitCodeNetworkError
+	}
+	return exitCodeClientError
+}
 
 func main() {
 
 	parseArgs()
 
+	if opts.AskPass {
+		askPassword()
+	}
+
+	if err := checkSettingArgs(); err != nil {
+		chcOutput.printServiceMsg(err.Error() + "\n")
+		os.Exit(1)
+	}
+
 	if isatty.IsTerminal(os.Stdin.Fd()) && isatty.IsTerminal(os.Stdout.Fd()) && len(opts.Query) == 0 {
 		opts.Progress = true
-		opts.Time = true
 		fmt.Printf("chc (ClickHouse CLI portable) %s\n", versionString)
-		fmt.Printf("Connecting to database %s at %s as user %s.\n", opts.Database, getHost(), opts.User)
+		fmt.Printf("Connecting to database %s at %s as user %s.\n", opts.Database, replicaList(), opts.User)
 
-		serverVersion, err := getServerVersion()
+		serverVersion, err := connectToReplica()
+		for attempt := 0; attempt < 3 && isAuthenticationError(err); attempt++ {
+			chcOutput.printServiceMsg(err.Error() + "\n")
+			askPassword()
+			serverVersion, err = getServerVersion()
+		}
 		if err != nil {
 			log.Fatalln(err)
 		}
 
+		if len(replicas) > 1 {
+			fmt.Printf("Connected to replica %s.\n", getHost())
+		}
 		fmt.Printf("Connected to ClickHouse server version %s.\n\n", serverVersion)
 
 		if len(opts.Pager) > 0 {
@@ -146,7 +242,25 @@ func main() {
 			opts.Format = formatTabSeparated
 		}
 
-		fireQuery(opts.Query, opts.Format, false)
+		var err error
+		// the query is sent only to the replica which is available
+		if len(replicas) > 1 {
+			_, err = connectToReplica()
+		}
+		if err != nil {
+			chcOutput.printServiceMsg(fmt.Sprintf("Unable to connect to %s: %s\n", replicaList(), err))
+		} else if opts.Multiquery {
+			err = fireQueries(opts.Query, opts.Format)
+		} else {
+			// query from stdin is not echoed, as stdin can contain data for insert as well
+			if len(opts.Query) > 0 {
+				echoQuery(opts.Query)
+			}
+			_, err = fireQuery(opts.Query, opts.Format, false)
+		}
+		if err != nil {
+			os.Exit(exitCode(err))
+		}
 	}
 
 }
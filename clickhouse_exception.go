@@ -0,0 +1,174 @@
+package main
+
+// Exceptions returned by the server. Text representation differs between versions:
+//   Code: 60. DB::Exception: Table default.x doesn't exist. (UNKNOWN_TABLE) (version 21.8.1.1)
+//   Code: 60, e.displayText() = DB::Exception: Table default.x doesn't exist., e.what() = DB::Exception
+// with stacktrace=1 the stack trace follows the message (after "Stack trace:" in old versions).
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+	"github.com/mattn/go-runewidth"
+)
+
+type serverException struct {
+	Code       int
+	Name       string // like UNKNOWN_TABLE, empty if unknown
+	Message    string // without the code and DB::Exception prefix
+	StackTrace string
+	Query      string // the text sent to the server, positions in the message point to it
+}
+
+func (e *serverException) Error() string {
+	message := fmt.Sprintf("Code: %d. DB::Exception: %s", e.Code, e.Message)
+	if len(e.Name) > 0 {
+		message += " (" + e.Name + ")"
+	}
+	return message
+}
+
+// names for the servers which don't add them to the message
+var exceptionNames = map[int]string{
+	36:  "BAD_ARGUMENTS",
+	41:  "CANNOT_PARSE_DATETIME",
+	42:  "NUMBER_OF_ARGUMENTS_DOESNT_MATCH",
+	43:  "ILLEGAL_TYPE_OF_ARGUMENT",
+	46:  "UNKNOWN_FUNCTION",
+	47:  "UNKNOWN_IDENTIFIER",
+	53:  "TYPE_MISMATCH",
+	57:  "TABLE_ALREADY_EXISTS",
+	60:  "UNKNOWN_TABLE",
+	62:  "SYNTAX_ERROR",
+	73:  "UNKNOWN_FORMAT",
+	81:  "UNKNOWN_DATABASE",
+	82:  "DATABASE_ALREADY_EXISTS",
+	115: "UNKNOWN_SETTING",
+	159: "TIMEOUT_EXCEEDED",
+	164: "READONLY",
+	192: "UNKNOWN_USER",
+	193: "WRONG_PASSWORD",
+	194: "REQUIRED_PASSWORD",
+	202: "TOO_MANY_SIMULTANEOUS_QUERIES",
+	209: "SOCKET_TIMEOUT",
+	210: "NETWORK_ERROR",
+	241: "MEMORY_LIMIT_EXCEEDED",
+	252: "TOO_MANY_PARTS",
+	394: "QUERY_WAS_CANCELLED",
+	497: "ACCESS_DENIED",
+	516: "AUTHENTICATION_FAILED",
+}
+
+var exceptionHeadRegexp = regexp.MustCompile("^\\s*Code: (\\d+)[.,]\\s*(?:e\\.displayText\\(\\) = )?")
+var exceptionNameRegexp = regexp.MustCompile("\\s*\\(([A-Z][A-Z0-9_]+)\\)$")
+var exceptionVersionRegexp = regexp.MustCompile("\\s*\\(version [^)]*\\)$")
+var exceptionWhatRegexp = regexp.MustCompile(",\\s*e\\.what\\(\\) = [\\w:]+$")
+
+// codeHeader is the value of X-ClickHouse-Exception-Code header (if any), it is used when the code is not found in the text
+func parseServerException(text, codeHeader string) *serverException {
+	e := &serverException{}
+	text = strings.TrimSpace(text)
+
+	if matches := exceptionHeadRegexp.FindStringSubmatch(text); matches != nil {
+		e.Code, _ = strconv.Atoi(matches[1])
+		text = text[len(matches[0]):]
+	} else if code, err := strconv.Atoi(strings.TrimSpace(codeHeader)); err == nil {
+		e.Code = code
+	}
+
+	if idx := strings.Index(text, "Stack trace:"); idx >= 0 {
+		e.StackTrace = strings.TrimSpace(text[idx+len("Stack trace:"):])
+		text = strings.TrimRight(text[:idx], " ,\n")
+	} else if idx := strings.Index(text, "\n\n0. "); idx >= 0 {
+		e.StackTrace = strings.TrimSpace(text[idx:])
+		text = text[:idx]
+	}
+	// in new versions the version follows the stack trace
+	e.StackTrace = exceptionVersionRegexp.ReplaceAllString(e.StackTrace, "")
+
+	text = strings.TrimSpace(text)
+	text = exceptionVersionRegexp.ReplaceAllString(text, "")
+	text = exceptionWhatRegexp.ReplaceAllString(text, "")
+	if matches := exceptionNameRegexp.FindStringSubmatch(text); matches != nil {
+		e.Name = matches[1]
+		text = text[:len(text)-len(matches[0])]
+	} else {
+		e.Name = exceptionNames[e.Code]
+	}
+	e.Message = strings.TrimPrefix(text, "DB::Exception: ")
+	return e
+}
+
+// nested exceptions are already mentioned in the message
+func (e *nativeException) serverException() *serverException {
+	se := parseServerException(e.Error(), "")
+	se.StackTrace = strings.TrimSpace(e.StackTrace)
+	return se
+}
+
+const (
+	colorError  = "\033[1;31m"
+	colorNotice = "\033[0;33m"
+	colorDim    = "\033[2m"
+	colorReset  = "\033[0m"
+)
+
+var syntaxErrorPositionRegexp = regexp.MustCompile("failed at position (\\d+)")
+
+// renders the exception for the user: message with the error name, the caret under the failing position
+// for syntax errors and the stack trace (only with --stacktrace)
+func (e *serverException) render() string {
+	colored := isatty.IsTerminal(os.Stderr.Fd())
+	color := func(c, s string) string {
+		if colored {
+			return c + s + colorReset
+		}
+		return s
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\nReceived exception from server")
+	if len(serverVersion) > 0 {
+		sb.WriteString(" (version " + serverVersion + ")")
+	}
+	sb.WriteString(":\n")
+	sb.WriteString(color(colorError, e.Error()) + "\n")
+
+	if matches := syntaxErrorPositionRegexp.FindStringSubmatch(e.Message); matches != nil {
+		position, err := strconv.Atoi(matches[1])
+		// position right after the text is the end of query
+		if err == nil && (position <= len(e.Query) || strings.Contains(e.Message, "end of query")) {
+			if line, column, ok := queryLineAtPosition(e.Query, position-1); ok {
+				sb.WriteString("\n" + line + "\n")
+				sb.WriteString(strings.Repeat(" ", column) + color(colorNotice, "^") + "\n")
+			}
+		}
+	}
+
+	if opts.Stacktrace && len(e.StackTrace) > 0 {
+		sb.WriteString("\n" + color(colorDim, "Stack trace:\n"+e.StackTrace) + "\n")
+	}
+	return sb.String()
+}
+
+// returns the line of the query which contains byte offset and display width of the text before it
+func queryLineAtPosition(query string, offset int) (line string, column int, ok bool) {
+	if offset < 0 || offset > len(query) {
+		return
+	}
+	lineStart := strings.LastIndexByte(query[:offset], '\n') + 1
+	lineEnd := strings.IndexByte(query[offset:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(query)
+	} else {
+		lineEnd += offset
+	}
+	// tabs would break the alignment of the caret
+	line = strings.Replace(query[lineStart:lineEnd], "\t", " ", -1)
+	column = runewidth.StringWidth(strings.Replace(query[lineStart:offset], "\t", " ", -1))
+	return line, column, true
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseServerException(t *testing.T) {
+	tests := []struct {
+		text       string
+		codeHeader string
+		want       serverException
+	}{
+		{
+			text: "Code: 60. DB::Exception: Table default.x doesn't exist. (UNKNOWN_TABLE) (version 21.8.1.1)\n",
+			want: serverException{Code: 60, Name: "UNKNOWN_TABLE", Message: "Table default.x doesn't exist."},
+		},
+		{
+			text: "Code: 60, e.displayText() = DB::Exception: Table default.x doesn't exist., e.what() = DB::Exception\n",
+			want: serverException{Code: 60, Name: "UNKNOWN_TABLE", Message: "Table default.x doesn't exist."},
+		},
+		{
+			text: "Code: 62, e.displayText() = DB::Exception: Syntax error: failed at position 8, e.what() = DB::Exception, Stack trace:\n\n0. 0x1 StackTrace::StackTrace()\n",
+			want: serverException{Code: 62, Name: "SYNTAX_ERROR", Message: "Syntax error: failed at position 8", StackTrace: "0. 0x1 StackTrace::StackTrace()"},
+		},
+		{
+			text: "Code: 999. DB::Exception: Something. (SOME_ERROR)\n\n0. 0x1 StackTrace::StackTrace()\n (version 23.8.1.1)",
+			want: serverException{Code: 999, Name: "SOME_ERROR", Message: "Something.", StackTrace: "0. 0x1 StackTrace::StackTrace()"},
+		},
+		{
+			text:       "DB::Exception: Memory limit exceeded",
+			codeHeader: "241",
+			want:       serverException{Code: 241, Name: "MEMORY_LIMIT_EXCEEDED", Message: "Memory limit exceeded"},
+		},
+		{
+			text: "Unexpected text",
+			want: serverException{Message: "Unexpected text"},
+		},
+	}
+	for _, test := range tests {
+		if got := parseServerException(test.text, test.codeHeader); *got != test.want {
+			t.Errorf("parseServerException(%q, %q) = %+v, want %+v", test.text, test.codeHeader, *got, test.want)
+		}
+	}
+}
+
+func TestServerExceptionCaret(t *testing.T) {
+	serverVersion = ""
+	tests := []struct {
+		query   string
+		message string
+		want    string // the line and the caret, empty if the caret is not expected
+	}{
+		{"SELECT\n\tfoo bar", "Syntax error: failed at position 13 ('bar')", "\n foo bar\n     ^\n"},
+		{"SELECT 'ü' bar", "Syntax error: failed at position 13 ('bar')", "\nSELECT 'ü' bar\n           ^\n"},
+		{"SELECT (", "Syntax error: failed at position 9 (end of query)", "\nSELECT (\n        ^\n"},
+		{"SELECT 1", "Syntax error: failed at position 42 ('x')", ""},
+	}
+	for _, test := range tests {
+		e := &serverException{Code: 62, Name: "SYNTAX_ERROR", Message: test.message, Query: test.query}
+		got := strings.TrimPrefix(e.render(), "\nReceived exception from server:\n"+e.Error()+"\n")
+		if got != test.want {
+			t.Errorf("caret for %q at %q = %q, want %q", test.query, test.message, got, test.want)
+		}
+	}
+}
@@ -4,8 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -18,7 +18,7 @@ import (
 )
 
 func getHost() string {
-	return fmt.Sprintf("%s:%d", opts.Host, opts.Port)
+	return activeReplica().String()
 }
 
 func prepareRequestReader(query io.Reader, format string, extraSettings map[string]string) (req *http.Request, err error) {
@@ -35,6 +35,10 @@ func prepareRequestReader(query io.Reader, format string, extraSettings map[stri
 		qsParams.Set("stacktrace", "1")
 	}
 
+	if len(opts.Compress) > 0 {
+		qsParams.Set("enable_http_compression", "1")
+	}
+
 	for k, v := range extraSettings {
 		qsParams.Set(k, v) // TODO: for readonly mode we can set up only few parameters
 	}
@@ -48,6 +52,9 @@ func prepareRequestReader(query io.Reader, format string, extraSettings map[stri
 
 	req.Header.Set("User-Agent", "chc/"+versionString)
 	req.SetBasicAuth(opts.User, opts.Password)
+	if len(opts.Compress) > 0 {
+		req.Header.Set("Accept-Encoding", opts.Compress)
+	}
 	return
 }
 
@@ -58,6 +65,10 @@ func prepareRequest(query, format string, extraSettings map[string]string) (req
 func serviceRequestWithExtraSetting(query string, extraSettings map[string]string, timeout_sec uint) (data [][]string, err error) {
 
 	timeout := time.Duration(time.Duration(timeout_sec) * time.Second)
+	if opts.Protocol == protocolNative {
+		return nativeServiceRequest(query, extraSettings, timeout)
+	}
+
 	cx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	req, err0 := prepareRequest(query, formatTabSeparated, extraSettings)
@@ -69,7 +80,7 @@ func serviceRequestWithExtraSetting(query string, extraSettings map[string]strin
 
 	req = req.WithContext(cx)
 
-	response, err2 := http.DefaultClient.Do(req)
+	response, err2 := httpClient.Do(req)
 	if err2 != nil {
 		err = err2
 		return
@@ -77,17 +88,24 @@ func serviceRequestWithExtraSetting(query string, extraSettings map[string]strin
 
 	defer response.Body.Close()
 
+	body, err4 := responseBody(response)
+	if err4 != nil {
+		err = err4
+		return
+	}
+	defer body.Close()
+
 	if response.StatusCode != 200 {
-		v, err3 := ioutil.ReadAll(response.Body)
+		v, err3 := ioutil.ReadAll(body)
 		if err3 != nil {
 			err = err3
 			return
 		}
-		err = errors.New(strings.TrimSpace(string(v)))
+		err = parseServerException(string(v), response.Header.Get("X-ClickHouse-Exception-Code"))
 		return
 	}
 
-	data, err = readTabSeparated(response.Body)
+	data, err = readTabSeparated(body)
 	return
 }
 
@@ -111,8 +129,118 @@ func killQuery(queryID string) bool {
 
 type queryExecutionChan chan queryExecution
 
+// after the query is cancelled nobody reads the channel, so the producers shouldn't block on it.
+// Returns false if the query is cancelled
+func sendPacket(cx context.Context, queryExecutionChannel chan queryExecution, qe queryExecution) bool {
+	select {
+	case queryExecutionChannel <- qe:
+		return true
+	case <-cx.Done():
+		return false
+	}
+}
+
+func queryRequestSettings(queryID string) map[string]string {
+	settings := map[string]string{"log_queries": "1", "query_id": queryID, "session_id": sessionID, "session_timeout": "1800"} // 30 min
+	for k, v := range userSettings() {
+		settings[k] = v
+	}
+	for k, v := range queryParameters {
+		settings["param_"+k] = v
+	}
+	return settings
+}
+
+// in non-interactive mode data from stdin (if any) is sent as a body, and query goes to url parameters
+func prepareQueryRequest(query, format string, interactive bool, extraSettings map[string]string) (req *http.Request, err error) {
+	format = httpRequestFormat(query, format)
+	if interactive || !hasDataInStdin() {
+		return prepareRequest(query, format, extraSettings)
+	}
+	if len(query) > 0 {
+		extraSettings["query"] = query
+	}
+	req, err = prepareRequestReader(os.Stdin, format, extraSettings)
+	stdinConsumed = true
+	if err == nil && len(opts.Compress) > 0 {
+		setRequestCompression(req, os.Stdin, opts.Compress)
+	}
+	return
+}
+
+// reads the response body line by line and sends the lines as data packets
+// returns nil error if the body was read till the end
+func streamResponseBody(cx context.Context, body io.Reader, format string, queryExecutionChannel chan queryExecution) (stats queryStats, err error) {
+	countRows := getRowsCounter(format)
+	bodyReader := bufio.NewReader(body)
+	for {
+		select {
+		case <-cx.Done():
+			return stats, cx.Err()
+		default:
+			msg, err := bodyReader.ReadString('\n')
+			if len(msg) > 0 {
+				stats.ResultRows = countRows(msg)
+				stats.ResultBytes += uint64(len(msg))
+				qe := queryExecution{PacketType: dataPacket, Data: msg}
+				if !sendPacket(cx, queryExecutionChannel, qe) {
+					return stats, cx.Err()
+				}
+			}
+			if err == io.EOF {
+				return stats, nil
+			} else if err != nil {
+				return stats, err
+			}
+		}
+	}
+}
+
+// response with status other than 200 contains the exception instead of the data
+// compressed response is decompressed here, before the rows are counted
+func streamQueryResponse(cx context.Context, response *http.Response, query, format string, queryExecutionChannel chan queryExecution) (stats queryStats, err error) {
+	body, err := responseBody(response)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+
+	if response.StatusCode == 200 {
+		if useClientSideFormat(query, format) {
+			return streamClientSideFormat(cx, body, query, format, queryExecutionChannel)
+		}
+		return streamResponseBody(cx, body, format, queryExecutionChannel)
+	}
+	exceptionText, err := ioutil.ReadAll(body)
+	if err != nil {
+		return
+	}
+	exception := parseServerException(string(exceptionText), response.Header.Get("X-ClickHouse-Exception-Code"))
+	exception.Query = query
+	sendPacket(cx, queryExecutionChannel, queryExecution{PacketType: exceptionPacket, Err: exception})
+	return
+}
+
 func makeQuery(cx context.Context, query, queryID, format string, interactive bool) queryExecutionChan {
 
+	if infile := parseInsertFromInfile(query); infile != nil {
+		if opts.Protocol == protocolNative {
+			queryExecutionChannel := make(chan queryExecution, 1)
+			queryExecutionChannel <- queryExecution{PacketType: errPacket, Err: errInfileNativeProtocol}
+			return queryExecutionChannel
+		}
+		return makeInsertFromInfile(cx, infile, queryID)
+	}
+
+	// native protocol sends progress packets itself, no polling needed
+	if opts.Protocol == protocolNative {
+		return makeNativeQuery(cx, query, queryID, format, interactive)
+	}
+
+	if opts.Progress && supportsHeadersProgress() {
+		return makeQueryWithHeadersProgress(cx, query, queryID, format, interactive)
+	}
+
 	queryExecutionChannel := make(chan queryExecution, 2048)
 	finishTickerChannel := make(chan bool, 3)
 
@@ -129,7 +257,7 @@ func makeQuery(cx context.Context, query, queryID, format string, interactive bo
 					pi, err := getProgressInfo(queryID)
 					if err == nil {
 						qe := queryExecution{Progress: pi, PacketType: progressPacket}
-						queryExecutionChannel <- qe
+						sendPacket(cx, queryExecutionChannel, qe)
 					}
 				case <-finishTickerChannel:
 					break Loop3
@@ -142,65 +270,41 @@ func makeQuery(cx context.Context, query, queryID, format string, interactive bo
 
 	go func() {
 		start := time.Now()
-		var count uint64 // = 0
-		countRows := getRowsCounter(format)
-		extraSettings := map[string]string{"log_queries": "1", "query_id": queryID, "session_id": sessionID, "session_timeout": "1800" } // 30 min
 		defer func() { finishTickerChannel <- true }()
-		var req *http.Request
-		var err error
-		if interactive || !hasDataInStdin() {
-			req, err = prepareRequest(query, format, extraSettings)
-		} else {
-			if len(query) > 0 {
-				extraSettings["query"] = query
-			}
-			req, err = prepareRequestReader(os.Stdin, format, extraSettings)
-		}
+		req, err := prepareQueryRequest(query, format, interactive, queryRequestSettings(queryID))
 		if err != nil {
 			qe := queryExecution{Err: err, PacketType: errPacket}
-			queryExecutionChannel <- qe
+			sendPacket(cx, queryExecutionChannel, qe)
 			return
 		}
 		req = req.WithContext(cx)
 
-		response, err := http.DefaultClient.Do(req)
+		response, err := httpClient.Do(req)
 		select {
 		case <-cx.Done():
 			// Already timedout
 		default:
 			if err != nil {
 				qe := queryExecution{Err: err, PacketType: errPacket}
-				queryExecutionChannel <- qe
+				sendPacket(cx, queryExecutionChannel, qe)
 			} else {
 				defer response.Body.Close()
 				qe := queryExecution{StatusCode: response.StatusCode, PacketType: statusPacket}
-				queryExecutionChannel <- qe
-				bodyReader := bufio.NewReader(response.Body)
-			Loop:
-				for {
-					//						io.WriteString(stdErr, "Debug P__\n\n" );
-					select {
-					case <-cx.Done():
-						break Loop
-					default:
-						msg, err := bodyReader.ReadString('\n')
-						if len(msg) > 0 {
-							count = countRows(msg)
-							qe := queryExecution{PacketType: dataPacket, Data: msg}
-							queryExecutionChannel <- qe
-						}
-						//spew.Dump(err)
-						//spew.Dump(msg)
-						if err == io.EOF {
-							stats := queryStats{QueryDuration: time.Since(start), ResultRows: count}
-							qe := queryExecution{PacketType: donePacket, Stats: stats}
-							queryExecutionChannel <- qe
-							break Loop
-						} else if err != nil {
-							qe := queryExecution{PacketType: errPacket, Err: err}
-							queryExecutionChannel <- qe
-							break Loop
-						}
+				if !sendPacket(cx, queryExecutionChannel, qe) {
+					return
+				}
+				stats, err := streamQueryResponse(cx, response, query, format, queryExecutionChannel)
+				select {
+				case <-cx.Done():
+				default:
+					if err != nil {
+						qe := queryExecution{PacketType: errPacket, Err: err}
+						sendPacket(cx, queryExecutionChannel, qe)
+					} else {
+						stats.QueryDuration = time.Since(start)
+						mergeSummaryHeader(&stats, response.Header)
+						qe := queryExecution{PacketType: donePacket, Stats: stats}
+						sendPacket(cx, queryExecutionChannel, qe)
 					}
 				}
 			}
@@ -212,117 +316,220 @@ func makeQuery(cx context.Context, query, queryID, format string, interactive bo
 
 }
 
-// another options - with progress in heeaders
-func makeQuery2(cx context.Context, query, queryID, format string, interactive bool) queryExecutionChan {
+func mergeSummaryHeader(stats *queryStats, header http.Header) {
+	if summary := header.Get("X-ClickHouse-Summary"); len(summary) > 0 {
+		if summaryStats, err := parseSummaryHeader(summary); err == nil {
+			stats.merge(summaryStats)
+		}
+	}
+}
+
+// send_progress_in_http_headers exists since v1.1.54159, but streaming of the result
+// together with progress headers (wait_end_of_query=0, http_headers_progress_interval_ms) appeared later
+const minHeadersProgressVersionMajor = 18
+const minHeadersProgressVersionMinor = 14
+
+const headersProgressIntervalMs = "100"
+
+func supportsHeadersProgress() bool {
+	return serverVersionAtLeast(minHeadersProgressVersionMajor, minHeadersProgressVersionMinor)
+}
+
+// idle keep-alive connection left after the previous query with progress in headers
+var headersProgressConn net.Conn
+
+func dialServer(cx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	server := activeReplica()
+	conn, err := dialer.DialContext(cx, "tcp", server.String())
+	if err != nil || opts.Protocol != "https" {
+		return conn, err
+	}
+	config := tlsConfig
+	if len(config.ServerName) == 0 {
+		config = config.Clone()
+		config.ServerName = server.Host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func closeOnCancel(cx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-cx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func parseProgressHeader(header string) (pi progressInfo, err error) {
+	type ProgressData struct {
+		ReadRows        uint64 `json:"read_rows,string"`
+		ReadBytes       uint64 `json:"read_bytes,string"`
+		WrittenRows     uint64 `json:"written_rows,string"`
+		WrittenBytes    uint64 `json:"written_bytes,string"`
+		TotalRows       uint64 `json:"total_rows,string"`
+		TotalRowsToRead uint64 `json:"total_rows_to_read,string"`
+	}
+	var pd ProgressData
+	if err = json.Unmarshal([]byte(header), &pd); err != nil {
+		return
+	}
+	pi = progressInfo{ReadRows: pd.ReadRows, ReadBytes: pd.ReadBytes, WrittenRows: pd.WrittenRows, WrittenBytes: pd.WrittenBytes, TotalRowsApprox: pd.TotalRows}
+	if pd.TotalRowsToRead > 0 {
+		pi.TotalRowsApprox = pd.TotalRowsToRead
+	}
+	return
+}
+
+// Progress comes in X-ClickHouse-Progress headers, which are sent before the body while query is running.
+// net/http returns the response only after all the headers are received, so the beginning
+// of the response is parsed manually and then replayed to http.ReadResponse.
+func makeQueryWithHeadersProgress(cx context.Context, query, queryID, format string, interactive bool) queryExecutionChan {
 
 	queryExecutionChannel := make(chan queryExecution, 2048)
 
 	go func() {
 		start := time.Now()
-		var count uint64 // = 0
-		countRows := getRowsCounter(format)
+		sendErr := func(err error) {
+			if cx.Err() == nil {
+				sendPacket(cx, queryExecutionChannel, queryExecution{Err: err, PacketType: errPacket})
+			}
+		}
 
-		extraSettings := map[string]string{"send_progress_in_http_headers": "1"}
+		extraSettings := queryRequestSettings(queryID)
+		extraSettings["send_progress_in_http_headers"] = "1"
+		extraSettings["http_headers_progress_interval_ms"] = headersProgressIntervalMs
+		extraSettings["wait_end_of_query"] = "0"
 
-		req, err := prepareRequest(query, opts.Format, extraSettings)
+		req, err := prepareQueryRequest(query, format, interactive, extraSettings)
 		if err != nil {
-			qe := queryExecution{Err: err, PacketType: errPacket}
-			queryExecutionChannel <- qe
+			sendErr(err)
 			return
 		}
 
-		conn, err := net.Dial("tcp", getHost()) // todo: ssl
-		defer conn.Close()                      // todo: keepalive
-		if err != nil {
-			qe := queryExecution{Err: err, PacketType: errPacket}
-			queryExecutionChannel <- qe
-			return
+		// the body from stdin can't be resent, so it always goes to the new connection
+		if req.GetBody == nil && headersProgressConn != nil {
+			headersProgressConn.Close()
+			headersProgressConn = nil
 		}
 
-		err = req.Write(conn)
-		if err != nil {
-			qe := queryExecution{Err: err, PacketType: errPacket}
-			queryExecutionChannel <- qe
-			return
+		var conn net.Conn
+		var stopWatching func()
+		var responseBeginning bytes.Buffer
+		var reader *bufio.Reader
+		var progress progressInfo
+
+		for {
+			reused := headersProgressConn != nil
+			conn = headersProgressConn
+			headersProgressConn = nil
+			if conn == nil {
+				if conn, err = dialServer(cx); err != nil {
+					sendErr(err)
+					return
+				}
+			}
+			stopWatching = closeOnCancel(cx, conn)
+
+			responseBeginning.Reset()
+			reader = bufio.NewReader(io.TeeReader(conn, &responseBeginning))
+			err = req.Write(conn)
+			if err == nil {
+				_, err = reader.Peek(1)
+			}
+			if err == nil {
+				break
+			}
+			stopWatching()
+			conn.Close()
+
+			// keep-alive connection can be already closed by server, then we retry with the new one
+			if !reused || req.GetBody == nil {
+				sendErr(err)
+				return
+			}
+			if req.Body, err = req.GetBody(); err != nil {
+				sendErr(err)
+				return
+			}
 		}
 
-		var requestBeginning bytes.Buffer
-		tee := io.TeeReader(conn, &requestBeginning)
-		reader := bufio.NewReader(tee)
+		// no need to keep the connection which state is unknown
+		defer func() {
+			if conn != nil {
+				stopWatching()
+				conn.Close()
+			}
+		}()
 
 	HeadersReadLoop:
 		for {
-			select {
-			case <-cx.Done():
-				return // Already timedout
-			default:
-				msg, err2 := reader.ReadString('\n')
-				if err2 != nil {
-					qe := queryExecution{Err: err2, PacketType: errPacket}
-					queryExecutionChannel <- qe
-					return
-					// Ups... We have error/EOF before HTTP headers finished...
-				}
-				message := strings.TrimSpace(msg)
-				if message == "" {
-					break HeadersReadLoop // header finished
-				}
-				//	fmt.Print(message)
-				if strings.HasPrefix(message, "X-ClickHouse-Progress:") {
-					type ProgressData struct {
-						ReadRows  uint64 `json:"read_rows,string"`
-						ReadBytes uint64 `json:"read_bytes,string"`
-						TotalRows uint64 `json:"total_rows,string"`
-					}
-					progressDataJSON := strings.TrimSpace(message[22:])
-					var pd ProgressData
-					err3 := json.Unmarshal([]byte(progressDataJSON), &pd)
-					if err3 == nil { // just ignore error here
-						pi := progressInfo{ReadRows: pd.ReadRows, Elapsed: float64(time.Since(start) / time.Second), ReadBytes: pd.ReadBytes, TotalRowsApprox: pd.TotalRows}
-						qe := queryExecution{Progress: pi, PacketType: progressPacket}
-						queryExecutionChannel <- qe
+			msg, err := reader.ReadString('\n')
+			if err != nil {
+				// Ups... We have error/EOF before HTTP headers finished...
+				sendErr(err)
+				return
+			}
+			message := strings.TrimSpace(msg)
+			switch {
+			case message == "":
+				break HeadersReadLoop // header finished
+			case strings.HasPrefix(message, "X-ClickHouse-Progress:"):
+				pi, err := parseProgressHeader(strings.TrimSpace(message[len("X-ClickHouse-Progress:"):]))
+				if err == nil { // just ignore error here
+					pi.Elapsed = time.Since(start).Seconds()
+					progress = pi
+					qe := queryExecution{Progress: pi, PacketType: progressPacket}
+					if !sendPacket(cx, queryExecutionChannel, qe) {
+						return
 					}
 				}
 			}
 		}
 
-		reader2 := io.MultiReader(&requestBeginning, conn)
-		reader3 := bufio.NewReader(reader2)
-		res, err := http.ReadResponse(reader3, req)
+		// responseBeginning contains everything read from connection so far (including read-ahead of the buffer)
+		res, err := http.ReadResponse(bufio.NewReader(io.MultiReader(&responseBeginning, conn)), req)
 		if err != nil {
-			qe := queryExecution{Err: err, PacketType: errPacket}
-			queryExecutionChannel <- qe
+			sendErr(err)
 			return
 		}
-		qe := queryExecution{StatusCode: res.StatusCode, PacketType: statusPacket}
-		queryExecutionChannel <- qe
 		defer res.Body.Close()
-		bodyReader := bufio.NewReader(res.Body)
 
-	Loop:
-		for {
-			select {
-			case <-cx.Done():
-				return // Already timedout
-			default:
-				msg, err := bodyReader.ReadString('\n')
-				if len(msg) > 0 {
-					count = countRows(msg)
-					qe := queryExecution{PacketType: dataPacket, Data: msg}
-					queryExecutionChannel <- qe
-				}
-				if err == io.EOF {
-					stats := queryStats{QueryDuration: time.Since(start), ResultRows: count}
-					qe := queryExecution{PacketType: donePacket, Stats: stats}
-					queryExecutionChannel <- qe
-					break Loop
-				} else if err != nil {
-					qe := queryExecution{PacketType: errPacket, Err: err}
-					queryExecutionChannel <- qe
-					break Loop
-				}
-			}
+		qe := queryExecution{StatusCode: res.StatusCode, PacketType: statusPacket}
+		if !sendPacket(cx, queryExecutionChannel, qe) {
+			return
 		}
+
+		stats, err := streamQueryResponse(cx, res, query, format, queryExecutionChannel)
+		if err != nil {
+			sendErr(err)
+			return
+		}
+
+		// connection should be detached from cancellation before the done packet,
+		// as the context is cancelled right after the query is finished
+		stopWatching()
+		if !res.Close {
+			headersProgressConn = conn
+		} else {
+			conn.Close()
+		}
+		conn = nil
+
+		stats.QueryDuration = time.Since(start)
+		stats.merge(queryStats{ReadRows: progress.ReadRows, ReadBytes: progress.ReadBytes, WrittenRows: progress.WrittenRows, WrittenBytes: progress.WrittenBytes})
+		mergeSummaryHeader(&stats, res.Header)
+		qe = queryExecution{PacketType: donePacket, Stats: stats}
+		sendPacket(cx, queryExecutionChannel, qe)
 	}()
 	return queryExecutionChannel
 }
@@ -0,0 +1,198 @@
+package main
+
+// Client-side rendering of Pretty formats for http. Server sends the result in TabSeparatedWithNamesAndTypes,
+// and it is drawn by the same code as for native protocol: tables fit the terminal width, NULLs are styled,
+// and the number of rows is known exactly.
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const clientSideRequestFormat = "TabSeparatedWithNamesAndTypes"
+
+// rows are collected into blocks to be drawn as separate tables (like the server does)
+const clientSideBlockRows = 1000
+
+const defaultPrettyMaxRows = 10000
+
+func isClientSideFormat(format string) bool {
+	switch format {
+	case "Pretty", "PrettyNoEscapes", "PrettyCompact", "PrettyCompactNoEscapes", "PrettyCompactMonoBlock", "PrettySpace", "PrettySpaceNoEscapes":
+		return true
+	}
+	return false
+}
+
+// FORMAT inside the query overrides default_format, so such queries are rendered by the server
+func useClientSideFormat(query, format string) bool {
+	return isClientSideFormat(format) && len(query) > 0 && !formatRegexp.MatchString(query)
+}
+
+func httpRequestFormat(query, format string) string {
+	if useClientSideFormat(query, format) {
+		return clientSideRequestFormat
+	}
+	return format
+}
+
+var tsvUnescaper = strings.NewReplacer(
+	"\\\\", "\\",
+	"\\'", "'",
+	"\\b", "\b",
+	"\\f", "\f",
+	"\\r", "\r",
+	"\\n", "\n",
+	"\\t", "\t",
+	"\\0", "\x00",
+)
+
+// fields are not unescaped, as \N (NULL) should be distinguished from escaped backslash followed by N
+func splitTSVLine(line string) []string {
+	return strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+}
+
+func unescapeTSVFields(fields []string) []string {
+	for idx, field := range fields {
+		fields[idx] = tsvUnescaper.Replace(field)
+	}
+	return fields
+}
+
+func prettyMaxRows() int {
+	if value, ok := userSettings()["output_format_pretty_max_rows"]; ok {
+		if maxRows, err := strconv.Atoi(value); err == nil {
+			return maxRows
+		}
+	}
+	return defaultPrettyMaxRows
+}
+
+// totals and extremes are separated by empty lines in TabSeparated, so the section is guessed by the query
+var totalsRegexp = regexp.MustCompile("(?i)\\bWITH\\s+TOTALS\\b")
+
+func isNullableType(typ string) bool {
+	return strings.HasPrefix(typ, "Nullable(") || strings.HasPrefix(typ, "LowCardinality(Nullable(")
+}
+
+func isExceptionInData(line string) bool {
+	return exceptionHeadRegexp.MatchString(line) && strings.Contains(line, "DB::Exception")
+}
+
+func streamClientSideFormat(cx context.Context, body io.Reader, query, format string, queryExecutionChannel chan queryExecution) (stats queryStats, err error) {
+	formatBlock := getNativeBlockFormatter(format)
+	bodyReader := bufio.NewReader(body)
+	maxRows := prettyMaxRows()
+
+	var names, types []string
+	var block *nativeBlock
+	packetType := uint64(nativeServerData)
+	sectionsLeft := []uint64{}
+	if totalsRegexp.MatchString(query) {
+		sectionsLeft = append(sectionsLeft, nativeServerTotals)
+	}
+	if userSettings()["extremes"] == "1" {
+		sectionsLeft = append(sectionsLeft, nativeServerExtremes)
+	}
+
+	newBlock := func() *nativeBlock {
+		b := &nativeBlock{Columns: make([]nativeColumn, len(names))}
+		for idx := range names {
+			b.Columns[idx] = nativeColumn{Name: names[idx], Type: types[idx]}
+			if isNullableType(types[idx]) {
+				b.Columns[idx].Nulls = []bool{}
+			}
+		}
+		return b
+	}
+	// false if the query is cancelled
+	flush := func() bool {
+		sent := true
+		if block != nil && block.Rows > 0 {
+			sent = sendPacket(cx, queryExecutionChannel, queryExecution{PacketType: dataPacket, Data: formatBlock(block, packetType)})
+		}
+		block = nil
+		return sent
+	}
+
+	for {
+		select {
+		case <-cx.Done():
+			return stats, cx.Err()
+		default:
+		}
+
+		line, readErr := bodyReader.ReadString('\n')
+		stats.ResultBytes += uint64(len(line))
+		switch {
+		case len(line) == 0:
+		case names == nil:
+			names = unescapeTSVFields(splitTSVLine(line))
+		case types == nil:
+			types = unescapeTSVFields(splitTSVLine(line))
+		// for single column the empty line can be the row with empty string
+		case line == "\n" && (len(names) > 1 || len(sectionsLeft) > 0):
+			if !flush() {
+				return stats, cx.Err()
+			}
+			packetType = nativeServerExtremes
+			if len(sectionsLeft) > 0 {
+				packetType, sectionsLeft = sectionsLeft[0], sectionsLeft[1:]
+			}
+		// with wait_end_of_query=0 the exception is appended to the data, after 200 status was sent
+		case isExceptionInData(line):
+			if !flush() {
+				return stats, cx.Err()
+			}
+			rest, _ := ioutil.ReadAll(bodyReader)
+			exception := parseServerException(line+string(rest), "")
+			exception.Query = query
+			sendPacket(cx, queryExecutionChannel, queryExecution{PacketType: exceptionPacket, Err: exception})
+			return stats, nil
+		default:
+			fields := splitTSVLine(line)
+			if len(fields) != len(names) {
+				flush()
+				return stats, fmt.Errorf("Malformed row in the result: %d fields instead of %d", len(fields), len(names))
+			}
+			if packetType == nativeServerData {
+				stats.ResultRows++
+				if stats.ResultRows > uint64(maxRows) {
+					break
+				}
+			}
+			if block == nil {
+				block = newBlock()
+			}
+			for idx, value := range fields {
+				column := &block.Columns[idx]
+				if column.Nulls != nil {
+					column.Nulls = append(column.Nulls, value == "\\N")
+				}
+				column.Values = append(column.Values, tsvUnescaper.Replace(value))
+			}
+			block.Rows++
+			if block.Rows >= clientSideBlockRows && !flush() {
+				return stats, cx.Err()
+			}
+		}
+
+		if readErr == io.EOF {
+			if !flush() {
+				return stats, cx.Err()
+			}
+			if stats.ResultRows > uint64(maxRows) {
+				sendPacket(cx, queryExecutionChannel, queryExecution{PacketType: dataPacket, Data: fmt.Sprintf("  Showed first %d.\n", maxRows)})
+			}
+			return stats, nil
+		} else if readErr != nil {
+			return stats, readErr
+		}
+	}
+}
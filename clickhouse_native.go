@@ -0,0 +1,818 @@
+package main
+
+// ClickHouse native (binary) protocol, the one used by clickhouse-client.
+// https://github.com/yandex/ClickHouse/blob/master/dbms/src/Core/Protocol.h
+// https://github.com/yandex/ClickHouse/blob/master/dbms/src/Server/TCPHandler.cpp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	nativeClientName         = "chc"
+	nativeClientVersionMajor = 1
+	nativeClientVersionMinor = 1
+	nativeClientVersionPatch = 0
+
+	// we announce the revision which still has simple settings serialization
+	// and does not require any of the newer (interserver, opentelemetry, etc.) fields
+	nativeProtocolRevision = 54429
+)
+
+// revisions which introduced protocol features we care about (see dbms/src/Core/Defines.h)
+const (
+	revisionWithTemporaryTables      = 50264
+	revisionWithTotalRowsInProgress  = 51554
+	revisionWithBlockInfo            = 51903
+	revisionWithClientInfo           = 54032
+	revisionWithServerTimezone       = 54058
+	revisionWithQuotaKeyInClientInfo = 54060
+	revisionWithServerDisplayName    = 54372
+	revisionWithVersionPatch         = 54401
+	revisionWithClientWriteInfo      = 54420
+	revisionWithSettingsAsStrings    = 54429
+)
+
+// packets sent by client
+const (
+	nativeClientHello  = 0
+	nativeClientQuery  = 1
+	nativeClientData   = 2
+	nativeClientCancel = 3
+	nativeClientPing   = 4
+)
+
+// packets sent by server
+const (
+	nativeServerHello        = 0
+	nativeServerData         = 1
+	nativeServerException    = 2
+	nativeServerProgress     = 3
+	nativeServerPong         = 4
+	nativeServerEndOfStream  = 5
+	nativeServerProfileInfo  = 6
+	nativeServerTotals       = 7
+	nativeServerExtremes     = 8
+	nativeServerTablesStatus = 9
+	nativeServerLog          = 10
+	nativeServerTableColumns = 11
+)
+
+const (
+	nativeStageComplete     = 2
+	nativeQueryKindInitial  = 1
+	nativeInterfaceTCP      = 1
+	nativeSettingImportant  = 1
+	nativeMaxStringLength   = 1 << 30
+	nativeConnectionTimeout = 10 * time.Second
+	// after Cancel the server should finish the stream, otherwise the connection is dropped
+	nativeCancelTimeout = 5 * time.Second
+)
+
+// settings which have a meaning only for http interface
+var httpOnlySettings = map[string]bool{
+	"query":           true,
+	"query_id":        true,
+	"session_id":      true,
+	"session_timeout": true,
+	"session_check":   true,
+	"default_format":  true,
+	"database":        true,
+	"stacktrace":      true,
+}
+
+type nativeException struct {
+	Code       int32
+	Name       string
+	Message    string
+	StackTrace string
+	Nested     *nativeException
+}
+
+func (e *nativeException) Error() string {
+	message := e.Message
+	if !strings.HasPrefix(message, e.Name) {
+		message = e.Name + ": " + message
+	}
+	return fmt.Sprintf("Code: %d. %s", e.Code, message)
+}
+
+type nativeProfileInfo struct {
+	Rows                      uint64
+	Blocks                    uint64
+	Bytes                     uint64
+	AppliedLimit              bool
+	RowsBeforeLimit           uint64
+	CalculatedRowsBeforeLimit bool
+}
+
+type nativePacket struct {
+	PacketType  uint64
+	Block       *nativeBlock
+	Progress    progressInfo
+	Exception   *nativeException
+	ProfileInfo nativeProfileInfo
+}
+
+type nativeReader struct {
+	rd *bufio.Reader
+}
+
+func (r *nativeReader) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(r.rd)
+}
+
+func (r *nativeReader) readBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r.rd, buf)
+	return buf, err
+}
+
+func (r *nativeReader) readString() (string, error) {
+	n, err := r.readUvarint()
+	if err != nil {
+		return "", err
+	}
+	if n > nativeMaxStringLength {
+		return "", fmt.Errorf("Too long string in native protocol: %d bytes", n)
+	}
+	buf, err := r.readBytes(int(n))
+	return string(buf), err
+}
+
+func (r *nativeReader) readUint8() (uint8, error) {
+	return r.rd.ReadByte()
+}
+
+func (r *nativeReader) readBool() (bool, error) {
+	v, err := r.rd.ReadByte()
+	return v != 0, err
+}
+
+func (r *nativeReader) readInt32() (int32, error) {
+	buf, err := r.readBytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return int32(binary.LittleEndian.Uint32(buf)), nil
+}
+
+func (r *nativeReader) readUint64() (uint64, error) {
+	buf, err := r.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+// bufio.Writer remembers the first error, so it's enough to check the result of flush
+type nativeWriter struct {
+	wr *bufio.Writer
+}
+
+func (w *nativeWriter) writeUvarint(v uint64) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	w.wr.Write(buf[:n])
+}
+
+func (w *nativeWriter) writeString(s string) {
+	w.writeUvarint(uint64(len(s)))
+	w.wr.WriteString(s)
+}
+
+func (w *nativeWriter) writeUint8(v uint8) {
+	w.wr.WriteByte(v)
+}
+
+func (w *nativeWriter) writeInt32(v int32) {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(v))
+	w.wr.Write(buf)
+}
+
+func (w *nativeWriter) flush() error {
+	return w.wr.Flush()
+}
+
+type nativeConn struct {
+	conn     net.Conn
+	r        nativeReader
+	w        nativeWriter
+	wm       sync.Mutex // Cancel is sent while the query is read
+	revision uint64
+	location *time.Location
+
+	ServerName        string
+	ServerVersion     string
+	ServerTimezone    string
+	ServerDisplayName string
+}
+
+func nativeConnect(timeout time.Duration) (nc *nativeConn, err error) {
+	conn, err := net.DialTimeout("tcp", getHost(), timeout)
+	if err != nil {
+		return
+	}
+	nc = &nativeConn{
+		conn:     conn,
+		r:        nativeReader{rd: bufio.NewReader(conn)},
+		w:        nativeWriter{wr: bufio.NewWriter(conn)},
+		location: time.UTC,
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	err = nc.hello()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		nc = nil
+	}
+	return
+}
+
+func (nc *nativeConn) close() {
+	nc.conn.Close()
+}
+
+func (nc *nativeConn) hello() error {
+	nc.w.writeUvarint(nativeClientHello)
+	nc.w.writeString(nativeClientName)
+	nc.w.writeUvarint(nativeClientVersionMajor)
+	nc.w.writeUvarint(nativeClientVersionMinor)
+	nc.w.writeUvarint(nativeProtocolRevision)
+	nc.w.writeString(opts.Database)
+	nc.w.writeString(opts.User)
+	nc.w.writeString(opts.Password)
+	if err := nc.w.flush(); err != nil {
+		return err
+	}
+
+	packetType, err := nc.r.readUvarint()
+	if err != nil {
+		return err
+	}
+
+	switch packetType {
+	case nativeServerHello:
+	case nativeServerException:
+		exception, err := nc.readException()
+		if err != nil {
+			return err
+		}
+		return exception
+	default:
+		return fmt.Errorf("Unexpected packet %d from server (expected Hello)", packetType)
+	}
+
+	var major, minor, patch, revision uint64
+	if nc.ServerName, err = nc.r.readString(); err != nil {
+		return err
+	}
+	if major, err = nc.r.readUvarint(); err != nil {
+		return err
+	}
+	if minor, err = nc.r.readUvarint(); err != nil {
+		return err
+	}
+	if revision, err = nc.r.readUvarint(); err != nil {
+		return err
+	}
+
+	nc.revision = revision
+	if nc.revision > nativeProtocolRevision {
+		nc.revision = nativeProtocolRevision
+	}
+
+	if nc.revision >= revisionWithServerTimezone {
+		if nc.ServerTimezone, err = nc.r.readString(); err != nil {
+			return err
+		}
+		if loc, err := time.LoadLocation(nc.ServerTimezone); err == nil {
+			nc.location = loc
+		}
+	}
+	if nc.revision >= revisionWithServerDisplayName {
+		if nc.ServerDisplayName, err = nc.r.readString(); err != nil {
+			return err
+		}
+	}
+	patch = revision
+	if nc.revision >= revisionWithVersionPatch {
+		if patch, err = nc.r.readUvarint(); err != nil {
+			return err
+		}
+	}
+	nc.ServerVersion = fmt.Sprintf("%d.%d.%d", major, minor, patch)
+	return nil
+}
+
+func (nc *nativeConn) ping(timeout time.Duration) error {
+	nc.conn.SetDeadline(time.Now().Add(timeout))
+	defer nc.conn.SetDeadline(time.Time{})
+
+	nc.w.writeUvarint(nativeClientPing)
+	if err := nc.w.flush(); err != nil {
+		return err
+	}
+	for {
+		packet, err := nc.readPacket()
+		if err != nil {
+			return err
+		}
+		switch packet.PacketType {
+		case nativeServerPong:
+			return nil
+		case nativeServerProgress: // can come after previous query, just skip
+		default:
+			return fmt.Errorf("Unexpected packet %d from server (expected Pong)", packet.PacketType)
+		}
+	}
+}
+
+func osUser() string {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = os.Getenv("USERNAME") // Windows style
+	}
+	return user
+}
+
+func (nc *nativeConn) sendQuery(queryID, query string, settings map[string]string) error {
+	nc.w.writeUvarint(nativeClientQuery)
+	nc.w.writeString(queryID)
+
+	if nc.revision >= revisionWithClientInfo {
+		hostname, _ := os.Hostname()
+		nc.w.writeUint8(nativeQueryKindInitial)
+		nc.w.writeString("") // initial_user
+		nc.w.writeString("") // initial_query_id
+		nc.w.writeString("[::ffff:127.0.0.1]:0")
+		nc.w.writeUint8(nativeInterfaceTCP)
+		nc.w.writeString(osUser())
+		nc.w.writeString(hostname)
+		nc.w.writeString(nativeClientName)
+		nc.w.writeUvarint(nativeClientVersionMajor)
+		nc.w.writeUvarint(nativeClientVersionMinor)
+		nc.w.writeUvarint(nativeProtocolRevision)
+		if nc.revision >= revisionWithQuotaKeyInClientInfo {
+			nc.w.writeString("") // quota_key
+		}
+		if nc.revision >= revisionWithVersionPatch {
+			nc.w.writeUvarint(nativeClientVersionPatch)
+		}
+	}
+
+	// older servers expect binary serialized settings with known types, so we just skip them there
+	if nc.revision >= revisionWithSettingsAsStrings {
+		names := make([]string, 0, len(settings))
+		for name := range settings {
+			if !httpOnlySettings[name] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			nc.w.writeString(name)
+			nc.w.writeUvarint(nativeSettingImportant) // so server will complain about unknown settings
+			nc.w.writeString(settings[name])
+		}
+	}
+	nc.w.writeString("") // end of settings
+
+	nc.w.writeUvarint(nativeStageComplete)
+	nc.w.writeUvarint(0) // compression disabled
+	nc.w.writeString(query)
+
+	// empty block means that there are no external tables
+	nc.writeEmptyBlock()
+	return nc.w.flush()
+}
+
+func (nc *nativeConn) writeEmptyBlock() {
+	nc.w.writeUvarint(nativeClientData)
+	if nc.revision >= revisionWithTemporaryTables {
+		nc.w.writeString("")
+	}
+	if nc.revision >= revisionWithBlockInfo {
+		nc.w.writeUvarint(1)
+		nc.w.writeUint8(0) // is_overflows
+		nc.w.writeUvarint(2)
+		nc.w.writeInt32(-1) // bucket_num
+		nc.w.writeUvarint(0)
+	}
+	nc.w.writeUvarint(0) // columns
+	nc.w.writeUvarint(0) // rows
+}
+
+func (nc *nativeConn) sendEmptyBlock() error {
+	nc.wm.Lock()
+	defer nc.wm.Unlock()
+	nc.writeEmptyBlock()
+	return nc.w.flush()
+}
+
+// the server stops the query and finishes the stream with EndOfStream or exception
+func (nc *nativeConn) sendCancel() error {
+	nc.wm.Lock()
+	defer nc.wm.Unlock()
+	nc.w.writeUvarint(nativeClientCancel)
+	return nc.w.flush()
+}
+
+func (nc *nativeConn) readException() (*nativeException, error) {
+	var err error
+	e := &nativeException{}
+	if e.Code, err = nc.r.readInt32(); err != nil {
+		return nil, err
+	}
+	if e.Name, err = nc.r.readString(); err != nil {
+		return nil, err
+	}
+	if e.Message, err = nc.r.readString(); err != nil {
+		return nil, err
+	}
+	if e.StackTrace, err = nc.r.readString(); err != nil {
+		return nil, err
+	}
+	hasNested, err := nc.r.readBool()
+	if err != nil {
+		return nil, err
+	}
+	if hasNested {
+		if e.Nested, err = nc.readException(); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// progress packets contain increments, not the totals
+func (nc *nativeConn) readProgress() (pi progressInfo, err error) {
+	if pi.ReadRows, err = nc.r.readUvarint(); err != nil {
+		return
+	}
+	if pi.ReadBytes, err = nc.r.readUvarint(); err != nil {
+		return
+	}
+	if nc.revision >= revisionWithTotalRowsInProgress {
+		if pi.TotalRowsApprox, err = nc.r.readUvarint(); err != nil {
+			return
+		}
+	}
+	if nc.revision >= revisionWithClientWriteInfo {
+		if pi.WrittenRows, err = nc.r.readUvarint(); err != nil {
+			return
+		}
+		if pi.WrittenBytes, err = nc.r.readUvarint(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (nc *nativeConn) readProfileInfo() (info nativeProfileInfo, err error) {
+	if info.Rows, err = nc.r.readUvarint(); err != nil {
+		return
+	}
+	if info.Blocks, err = nc.r.readUvarint(); err != nil {
+		return
+	}
+	if info.Bytes, err = nc.r.readUvarint(); err != nil {
+		return
+	}
+	if info.AppliedLimit, err = nc.r.readBool(); err != nil {
+		return
+	}
+	if info.RowsBeforeLimit, err = nc.r.readUvarint(); err != nil {
+		return
+	}
+	info.CalculatedRowsBeforeLimit, err = nc.r.readBool()
+	return
+}
+
+func (nc *nativeConn) readBlock() (*nativeBlock, error) {
+	if nc.revision >= revisionWithTemporaryTables {
+		if _, err := nc.r.readString(); err != nil { // external table name
+			return nil, err
+		}
+	}
+	return readNativeBlock(&nc.r, nc.revision, nc.location)
+}
+
+func (nc *nativeConn) readPacket() (packet nativePacket, err error) {
+	if packet.PacketType, err = nc.r.readUvarint(); err != nil {
+		return
+	}
+
+	switch packet.PacketType {
+	case nativeServerData, nativeServerTotals, nativeServerExtremes, nativeServerLog:
+		packet.Block, err = nc.readBlock()
+	case nativeServerException:
+		packet.Exception, err = nc.readException()
+	case nativeServerProgress:
+		packet.Progress, err = nc.readProgress()
+	case nativeServerProfileInfo:
+		packet.ProfileInfo, err = nc.readProfileInfo()
+	case nativeServerTableColumns:
+		if _, err = nc.r.readString(); err == nil { // external table name
+			_, err = nc.r.readString() // columns description
+		}
+	case nativeServerPong, nativeServerEndOfStream:
+	default:
+		err = fmt.Errorf("Unknown packet %d from server", packet.PacketType)
+	}
+	return
+}
+
+// connection used for user queries, it keeps the session state (like settings) between queries. The query
+// takes it for the time it's executed and puts it back at the end of the stream, so a cancelled query which
+// still reads its stream doesn't touch the connection of the next one
+var nativeSession *nativeConn
+var nativeSessionMutex sync.Mutex
+
+// incremented when the session is dropped, connections taken before that are not put back
+var nativeSessionEpoch int
+
+// the connection of the session or a new one, it's owned by the caller till putNativeSession
+func takeNativeSession() (nc *nativeConn, epoch int, err error) {
+	nativeSessionMutex.Lock()
+	nc, epoch = nativeSession, nativeSessionEpoch
+	nativeSession = nil
+	nativeSessionMutex.Unlock()
+
+	if nc != nil {
+		if nc.ping(nativeConnectionTimeout) == nil {
+			return
+		}
+		nc.close()
+	}
+	nc, err = nativeConnect(nativeConnectionTimeout)
+	return
+}
+
+// the connection should be at the end of the stream
+func putNativeSession(nc *nativeConn, epoch int) {
+	nativeSessionMutex.Lock()
+	defer nativeSessionMutex.Unlock()
+	if epoch != nativeSessionEpoch || nativeSession != nil {
+		nc.close()
+		return
+	}
+	nativeSession = nc
+}
+
+// new connection is made for the next query (after replica switch, new password etc.)
+func dropNativeSession() {
+	nativeSessionMutex.Lock()
+	defer nativeSessionMutex.Unlock()
+	nativeSessionEpoch++
+	if nativeSession != nil {
+		nativeSession.close()
+		nativeSession = nil
+	}
+}
+
+// runs the query (like SET) on the connection of the session, the result is ignored
+func nativeSessionExec(query string) error {
+	nc, epoch, err := takeNativeSession()
+	if err != nil {
+		return err
+	}
+	nc.conn.SetDeadline(time.Now().Add(nativeConnectionTimeout))
+	if err = nc.sendQuery(get_id(), query, nativeSettings(nil)); err != nil {
+		nc.close()
+		return err
+	}
+	for {
+		packet, err := nc.readPacket()
+		if err != nil {
+			nc.close()
+			return err
+		}
+		switch packet.PacketType {
+		case nativeServerException, nativeServerEndOfStream:
+			nc.conn.SetDeadline(time.Time{})
+			putNativeSession(nc, epoch)
+			if packet.PacketType == nativeServerException {
+				return packet.Exception.serverException()
+			}
+			return nil
+		}
+	}
+}
+
+func nativeServiceRequest(query string, extraSettings map[string]string, timeout time.Duration) (data [][]string, err error) {
+	nc, err := nativeConnect(timeout)
+	if err != nil {
+		return
+	}
+	defer nc.close()
+
+	nc.conn.SetDeadline(time.Now().Add(timeout))
+	if err = nc.sendQuery(get_id(), query, nativeSettings(extraSettings)); err != nil {
+		return
+	}
+
+	for {
+		packet, err2 := nc.readPacket()
+		if err2 != nil {
+			err = err2
+			return
+		}
+		switch packet.PacketType {
+		case nativeServerData:
+			data = append(data, packet.Block.stringRows()...)
+		case nativeServerException:
+			err = packet.Exception
+			return
+		case nativeServerEndOfStream:
+			return
+		}
+	}
+}
+
+func nativeSettings(extraSettings map[string]string) map[string]string {
+	settings := map[string]string{
+		// we don't want to decode LowCardinality dictionaries
+		"low_cardinality_allow_in_native_format": "0",
+	}
+	for k, v := range extraSettings {
+		settings[k] = v
+	}
+	return settings
+}
+
+var insertQueryRegexp = regexp.MustCompile("^\\s*(?i)insert\\s+")
+
+func makeNativeQuery(cx context.Context, query, queryID, format string, interactive bool) queryExecutionChan {
+	queryExecutionChannel := make(chan queryExecution, 2048)
+
+	send := func(qe queryExecution) bool {
+		return sendPacket(cx, queryExecutionChannel, qe)
+	}
+
+	go func() {
+		start := time.Now()
+		var resultRows, resultBytes uint64
+		var progress progressInfo
+
+		if !interactive && hasDataInStdin() {
+			if len(query) > 0 {
+				send(queryExecution{PacketType: errPacket, Err: errors.New("Sending data from stdin is not supported for native protocol, use --protocol=http")})
+				return
+			}
+			stdinQuery, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				send(queryExecution{PacketType: errPacket, Err: err})
+				return
+			}
+			stdinConsumed = true
+			query = string(stdinQuery)
+		}
+
+		// parameters are sent in query packet only since revision 54459
+		if len(queryParameters) > 0 {
+			send(queryExecution{PacketType: errPacket, Err: errors.New("Query parameters are not supported for native protocol, use --protocol=http")})
+			return
+		}
+
+		nc, epoch, err := takeNativeSession()
+		if err != nil {
+			send(queryExecution{PacketType: errPacket, Err: err})
+			return
+		}
+
+		settings := nativeSettings(userSettings())
+		settings["log_queries"] = "1"
+		if err = nc.sendQuery(queryID, query, settings); err != nil {
+			nc.close()
+			send(queryExecution{PacketType: errPacket, Err: err})
+			return
+		}
+
+		finished := make(chan struct{})
+		watcherDone := make(chan struct{})
+		go func() {
+			defer close(watcherDone)
+			select {
+			case <-cx.Done():
+				// the stream is read till its end, so the connection (and the session) can be used further.
+				// If the server doesn't answer, the blocking read below is interrupted
+				nc.sendCancel()
+				nc.conn.SetReadDeadline(time.Now().Add(nativeCancelTimeout))
+			case <-finished:
+			}
+		}()
+		// after it the connection is not touched by the watcher
+		stopWatcher := func() {
+			close(finished)
+			<-watcherDone
+		}
+
+		formatBlock := getNativeBlockFormatter(format)
+		isInsert := insertQueryRegexp.MatchString(query)
+		statusSent := false
+		sendStatus := func(status int) {
+			if !statusSent {
+				statusSent = true
+				send(queryExecution{PacketType: statusPacket, StatusCode: status})
+			}
+		}
+		sendText := func(text string) {
+			for _, line := range strings.SplitAfter(text, "\n") {
+				if len(line) > 0 && !send(queryExecution{PacketType: dataPacket, Data: line}) {
+					return
+				}
+			}
+		}
+
+		// after cancellation nobody reads the channel, but the stream is still read till its end
+		for {
+			packet, err := nc.readPacket()
+			if err != nil {
+				stopWatcher()
+				nc.close()
+				if cx.Err() == nil {
+					send(queryExecution{PacketType: errPacket, Err: err})
+				}
+				return
+			}
+
+			switch packet.PacketType {
+			case nativeServerData, nativeServerTotals, nativeServerExtremes:
+				sendStatus(200)
+				block := packet.Block
+				// for INSERT server sends the header of the table and waits for the data
+				// all the data we have is already inside the query, so we just finish the stream
+				if isInsert && packet.PacketType == nativeServerData && block.Rows == 0 {
+					isInsert = false
+					if err = nc.sendEmptyBlock(); err != nil {
+						stopWatcher()
+						nc.close()
+						send(queryExecution{PacketType: errPacket, Err: err})
+						return
+					}
+					continue
+				}
+				if packet.PacketType == nativeServerData {
+					resultRows += uint64(block.Rows)
+				}
+				if cx.Err() == nil {
+					sendText(formatBlock(block, packet.PacketType))
+				}
+			case nativeServerProgress:
+				progress.ReadRows += packet.Progress.ReadRows
+				progress.ReadBytes += packet.Progress.ReadBytes
+				progress.TotalRowsApprox += packet.Progress.TotalRowsApprox
+				progress.WrittenRows += packet.Progress.WrittenRows
+				progress.WrittenBytes += packet.Progress.WrittenBytes
+				progress.Elapsed = time.Since(start).Seconds()
+				if opts.Progress {
+					send(queryExecution{PacketType: progressPacket, Progress: progress})
+				}
+			case nativeServerProfileInfo:
+				resultBytes = packet.ProfileInfo.Bytes
+			case nativeServerException:
+				sendStatus(500)
+				exception := packet.Exception.serverException()
+				exception.Query = query
+				send(queryExecution{PacketType: exceptionPacket, Err: exception})
+				fallthrough
+			case nativeServerEndOfStream:
+				stopWatcher()
+				nc.conn.SetDeadline(time.Time{})
+				putNativeSession(nc, epoch)
+
+				sendStatus(200)
+				stats := queryStats{
+					QueryDuration: time.Since(start),
+					ReadRows:      progress.ReadRows,
+					ReadBytes:     progress.ReadBytes,
+					WrittenRows:   progress.WrittenRows,
+					WrittenBytes:  progress.WrittenBytes,
+					ResultRows:    resultRows,
+					ResultBytes:   resultBytes,
+					ServerStats:   true,
+				}
+				send(queryExecution{PacketType: donePacket, Stats: stats})
+				return
+			}
+		}
+	}()
+
+	return queryExecutionChannel
+}
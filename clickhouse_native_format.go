@@ -0,0 +1,407 @@
+package main
+
+// Output formats for native protocol. With native protocol server sends the data in Native format,
+// so formatting into text should be done on client side (like clickhouse-client does).
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/chzyer/readline" // only console width used from there...
+	"github.com/mattn/go-isatty"
+	"github.com/mattn/go-runewidth"
+)
+
+const nullDisplayValue = "ᴺᵁᴸᴸ"
+
+type nativeBlockFormatter func(block *nativeBlock, packetType uint64) string
+
+func getNativeBlockFormatter(format string) nativeBlockFormatter {
+	switch format {
+	case formatTabSeparated, "TSV":
+		return tabSeparatedFormatter(false, false, true)
+	case "TabSeparatedRaw", "TSVRaw":
+		return tabSeparatedFormatter(false, false, false)
+	case "TabSeparatedWithNames", "TSVWithNames":
+		return tabSeparatedFormatter(true, false, true)
+	case "TabSeparatedWithNamesAndTypes", "TSVWithNamesAndTypes":
+		return tabSeparatedFormatter(true, true, true)
+	case "CSV":
+		return csvFormatter(false)
+	case "CSVWithNames":
+		return csvFormatter(true)
+	case formatVertical, "VerticalRaw":
+		return verticalFormatter()
+	case "Pretty", "PrettyNoEscapes":
+		return prettyFormatter(prettyStyleFull)
+	case "PrettyCompact", "PrettyCompactNoEscapes", "PrettyCompactMonoBlock":
+		return prettyFormatter(prettyStyleCompact)
+	case "PrettySpace", "PrettySpaceNoEscapes":
+		return prettyFormatter(prettyStyleSpace)
+	case "Null":
+		return func(block *nativeBlock, packetType uint64) string { return "" }
+	default:
+		chcOutput.printServiceMsg("Format " + format + " is not supported with native protocol, " + formatTabSeparated + " is used instead\n")
+		return tabSeparatedFormatter(false, false, true)
+	}
+}
+
+// totals and extremes are separated from the data with an empty line
+func blockSectionTitle(packetType uint64) string {
+	switch packetType {
+	case nativeServerTotals:
+		return "Totals"
+	case nativeServerExtremes:
+		return "Extremes"
+	}
+	return ""
+}
+
+func tabSeparatedFormatter(withNames, withTypes, escape bool) nativeBlockFormatter {
+	headerWritten := false
+	return func(block *nativeBlock, packetType uint64) string {
+		var sb strings.Builder
+		writeLine := func(values []string) {
+			sb.WriteString(strings.Join(values, "\t"))
+			sb.WriteString("\n")
+		}
+
+		if !headerWritten {
+			headerWritten = true
+			if withNames {
+				names := make([]string, len(block.Columns))
+				for idx, column := range block.Columns {
+					names[idx] = escapeString(column.Name)
+				}
+				writeLine(names)
+			}
+			if withTypes {
+				types := make([]string, len(block.Columns))
+				for idx, column := range block.Columns {
+					types[idx] = escapeString(column.Type)
+				}
+				writeLine(types)
+			}
+		}
+
+		if block.Rows > 0 && len(blockSectionTitle(packetType)) > 0 {
+			sb.WriteString("\n")
+		}
+
+		for row := 0; row < block.Rows; row++ {
+			values := make([]string, len(block.Columns))
+			for idx, column := range block.Columns {
+				switch {
+				case column.isNull(row):
+					values[idx] = "\\N"
+				case escape && !isCompositeType(column.Type):
+					// values inside arrays and tuples are already quoted
+					values[idx] = escapeString(column.Values[row])
+				default:
+					values[idx] = column.Values[row]
+				}
+			}
+			writeLine(values)
+		}
+		return sb.String()
+	}
+}
+
+func quoteCSV(s string) string {
+	return "\"" + strings.Replace(s, "\"", "\"\"", -1) + "\""
+}
+
+func csvFormatter(withNames bool) nativeBlockFormatter {
+	headerWritten := false
+	return func(block *nativeBlock, packetType uint64) string {
+		var sb strings.Builder
+		if !headerWritten {
+			headerWritten = true
+			if withNames {
+				names := make([]string, len(block.Columns))
+				for idx, column := range block.Columns {
+					names[idx] = quoteCSV(column.Name)
+				}
+				sb.WriteString(strings.Join(names, ",") + "\n")
+			}
+		}
+
+		if block.Rows > 0 && len(blockSectionTitle(packetType)) > 0 {
+			sb.WriteString("\n")
+		}
+
+		for row := 0; row < block.Rows; row++ {
+			values := make([]string, len(block.Columns))
+			for idx, column := range block.Columns {
+				switch {
+				case column.isNull(row):
+					values[idx] = "\\N"
+				case isNumericType(column.Type):
+					values[idx] = column.Values[row]
+				default:
+					values[idx] = quoteCSV(column.Values[row])
+				}
+			}
+			sb.WriteString(strings.Join(values, ",") + "\n")
+		}
+		return sb.String()
+	}
+}
+
+func verticalFormatter() nativeBlockFormatter {
+	rowNumber := 0
+	return func(block *nativeBlock, packetType uint64) string {
+		var sb strings.Builder
+
+		nameWidth := 0
+		for _, column := range block.Columns {
+			if w := runewidth.StringWidth(column.Name); w > nameWidth {
+				nameWidth = w
+			}
+		}
+
+		for row := 0; row < block.Rows; row++ {
+			title := blockSectionTitle(packetType) + ":"
+			if packetType == nativeServerData {
+				rowNumber++
+				title = "Row " + strconv.Itoa(rowNumber) + ":"
+			}
+			if rowNumber > 1 || packetType != nativeServerData {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(title + "\n")
+			sb.WriteString(strings.Repeat("─", runewidth.StringWidth(title)) + "\n")
+			for _, column := range block.Columns {
+				value := nullDisplayValue
+				if !column.isNull(row) {
+					value = escapePretty(column.Values[row])
+				}
+				sb.WriteString(column.Name + ": " + strings.Repeat(" ", nameWidth-runewidth.StringWidth(column.Name)) + value + "\n")
+			}
+		}
+		return sb.String()
+	}
+}
+
+const ( // iota is reset to 0
+	prettyStyleFull    = iota
+	prettyStyleCompact = iota
+	prettyStyleSpace   = iota
+)
+
+// only control characters are escaped to keep the table in shape
+var prettyEscaper = strings.NewReplacer(
+	"\b", "\\b",
+	"\f", "\\f",
+	"\r", "\\r",
+	"\n", "\\n",
+	"\t", "\\t",
+	"\x00", "\\0",
+)
+
+func escapePretty(s string) string {
+	return prettyEscaper.Replace(s)
+}
+
+// tables are fitted into the terminal only when they go directly to it
+func prettyOutputToTerminal() bool {
+	return chcOutput.outputMode == omStd && isatty.IsTerminal(os.Stdout.Fd())
+}
+
+// columns narrower than that are not truncated to fit the table into the terminal
+const prettyMinColumnWidth = 10
+
+func sumWidths(widths []int) (sum int) {
+	for _, w := range widths {
+		sum += w
+	}
+	return
+}
+
+// largest limit for the column width which allows to fit the table into maxWidth,
+// tableWidth is the width of the table without the column contents (borders and spaces)
+func fitColumnWidths(widths []int, tableWidth, maxWidth int) {
+	total := func(limit int) int {
+		sum := tableWidth
+		for _, w := range widths {
+			if w > limit {
+				w = limit
+			}
+			sum += w
+		}
+		return sum
+	}
+
+	low, high := prettyMinColumnWidth, 0
+	for _, w := range widths {
+		if w > high {
+			high = w
+		}
+	}
+	if total(high) <= maxWidth {
+		return
+	}
+	for low < high {
+		mid := (low + high + 1) / 2
+		if total(mid) <= maxWidth {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	for idx, w := range widths {
+		if w > low {
+			widths[idx] = low
+		}
+	}
+}
+
+func prettyFormatter(style int) nativeBlockFormatter {
+	// in auto expanded mode the result is switched to vertical layout after the first block which doesn't fit
+	var vertical nativeBlockFormatter
+	return func(block *nativeBlock, packetType uint64) string {
+		if block.Rows == 0 {
+			return ""
+		}
+		if vertical != nil {
+			return vertical(block, packetType)
+		}
+		toTerminal := prettyOutputToTerminal()
+
+		cells := make([][]string, block.Rows)
+		widths := make([]int, len(block.Columns))
+		rightAligned := make([]bool, len(block.Columns))
+		for idx, column := range block.Columns {
+			widths[idx] = runewidth.StringWidth(column.Name)
+			rightAligned[idx] = isNumericType(column.Type)
+		}
+		for row := range cells {
+			cells[row] = make([]string, len(block.Columns))
+			for idx, column := range block.Columns {
+				value := nullDisplayValue
+				if !column.isNull(row) {
+					value = escapePretty(column.Values[row])
+				}
+				cells[row][idx] = value
+				if w := runewidth.StringWidth(value); w > widths[idx] {
+					widths[idx] = w
+				}
+			}
+		}
+
+		if toTerminal {
+			tableWidth := 3*len(widths) + 1
+			if style == prettyStyleSpace {
+				tableWidth = 3*len(widths) - 2
+			}
+			screenWidth := readline.GetScreenWidth()
+			if expandedMode == expandedAuto && tableWidth+sumWidths(widths) > screenWidth {
+				vertical = verticalFormatter()
+				return vertical(block, packetType)
+			}
+			fitColumnWidths(widths, tableWidth, screenWidth)
+		}
+
+		pad := func(value string, idx int, filler string) string {
+			if runewidth.StringWidth(value) > widths[idx] {
+				value = runewidth.Truncate(value, widths[idx], "…")
+			}
+			padding := strings.Repeat(filler, widths[idx]-runewidth.StringWidth(value))
+			// NULL is shown dimmed, so it's distinguishable from 'NULL' string
+			if toTerminal && value == nullDisplayValue {
+				value = colorDim + value + colorReset
+			}
+			if rightAligned[idx] {
+				return padding + value
+			}
+			return value + padding
+		}
+		line := func(left, fill, middle, right string) string {
+			parts := make([]string, len(widths))
+			for idx, w := range widths {
+				parts[idx] = strings.Repeat(fill, w+2)
+			}
+			return left + strings.Join(parts, middle) + right + "\n"
+		}
+		row := func(values []string, border, filler string) string {
+			parts := make([]string, len(values))
+			for idx, value := range values {
+				parts[idx] = pad(value, idx, filler)
+			}
+			return border + " " + strings.Join(parts, " "+border+" ") + " " + border + "\n"
+		}
+
+		names := make([]string, len(block.Columns))
+		for idx, column := range block.Columns {
+			names[idx] = column.Name
+		}
+
+		var sb strings.Builder
+		if title := blockSectionTitle(packetType); len(title) > 0 {
+			sb.WriteString("\n" + title + ":\n")
+		}
+
+		switch style {
+		case prettyStyleFull:
+			sb.WriteString(line("┏", "━", "┳", "┓"))
+			sb.WriteString(row(names, "┃", " "))
+			sb.WriteString(line("┡", "━", "╇", "┩"))
+			for idx, values := range cells {
+				if idx > 0 {
+					sb.WriteString(line("├", "─", "┼", "┤"))
+				}
+				sb.WriteString(row(values, "│", " "))
+			}
+			sb.WriteString(line("└", "─", "┴", "┘"))
+		case prettyStyleCompact:
+			header := make([]string, len(names))
+			for idx, name := range names {
+				header[idx] = "─" + pad(name, idx, "─") + "─"
+			}
+			sb.WriteString("┌" + strings.Join(header, "┬") + "┐\n")
+			for _, values := range cells {
+				sb.WriteString(row(values, "│", " "))
+			}
+			sb.WriteString(line("└", "─", "┴", "┘"))
+		case prettyStyleSpace:
+			writeSpaced := func(values []string) {
+				parts := make([]string, len(values))
+				for idx, value := range values {
+					parts[idx] = pad(value, idx, " ")
+				}
+				sb.WriteString(" " + strings.TrimRight(strings.Join(parts, "   "), " ") + "\n")
+			}
+			writeSpaced(names)
+			sb.WriteString("\n")
+			for _, values := range cells {
+				writeSpaced(values)
+			}
+		}
+		return sb.String()
+	}
+}
+
+func isCompositeType(typ string) bool {
+	if strings.HasPrefix(typ, "Nullable(") || strings.HasPrefix(typ, "LowCardinality(") {
+		return isCompositeType(typeParameters(typ))
+	}
+	if _, ok := nativeTypeAliases[typ]; ok {
+		return true
+	}
+	return strings.HasPrefix(typ, "Array(") || strings.HasPrefix(typ, "Tuple(") || strings.HasPrefix(typ, "Map(")
+}
+
+func isNumericType(typ string) bool {
+	for _, wrapper := range []string{"Nullable(", "LowCardinality("} {
+		if strings.HasPrefix(typ, wrapper) {
+			return isNumericType(typeParameters(typ))
+		}
+	}
+	for _, prefix := range []string{"UInt", "Int", "Float", "Decimal"} {
+		if strings.HasPrefix(typ, prefix) && !strings.HasPrefix(typ, "Interval") {
+			return true
+		}
+	}
+	return false
+}
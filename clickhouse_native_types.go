@@ -0,0 +1,639 @@
+package main
+
+// Decoding of Native format blocks into text values
+// https://github.com/yandex/ClickHouse/blob/master/dbms/src/DataStreams/NativeBlockInputStream.cpp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type nativeColumn struct {
+	Name   string
+	Type   string
+	Values []string
+	Nulls  []bool // nil for non-Nullable columns
+}
+
+type nativeBlock struct {
+	Columns []nativeColumn
+	Rows    int
+}
+
+func (column *nativeColumn) isNull(row int) bool {
+	return column.Nulls != nil && column.Nulls[row]
+}
+
+// rows in the same shape as readTabSeparated returns them
+func (block *nativeBlock) stringRows() [][]string {
+	res := make([][]string, block.Rows)
+	for row := range res {
+		res[row] = make([]string, len(block.Columns))
+		for idx, column := range block.Columns {
+			if column.isNull(row) {
+				res[row][idx] = "\\N"
+			} else {
+				res[row][idx] = column.Values[row]
+			}
+		}
+	}
+	return res
+}
+
+func readNativeBlock(r *nativeReader, revision uint64, loc *time.Location) (*nativeBlock, error) {
+	if revision >= revisionWithBlockInfo {
+	BlockInfoLoop:
+		for {
+			fieldNum, err := r.readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			switch fieldNum {
+			case 0:
+				break BlockInfoLoop
+			case 1: // is_overflows
+				_, err = r.readBool()
+			case 2: // bucket_num
+				_, err = r.readInt32()
+			default:
+				err = fmt.Errorf("Unknown block info field %d", fieldNum)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	numColumns, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	numRows, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	block := &nativeBlock{Rows: int(numRows)}
+	for i := uint64(0); i < numColumns; i++ {
+		column := nativeColumn{}
+		if column.Name, err = r.readString(); err != nil {
+			return nil, err
+		}
+		if column.Type, err = r.readString(); err != nil {
+			return nil, err
+		}
+		// zero rows are always represented as zero bytes of data
+		if numRows > 0 {
+			column.Values, column.Nulls, err = readNativeColumn(r, column.Type, block.Rows, loc, false)
+			if err != nil {
+				return nil, err
+			}
+		}
+		block.Columns = append(block.Columns, column)
+	}
+	return block, nil
+}
+
+// aliases of composite types
+var nativeTypeAliases = map[string]string{
+	"Point":           "Tuple(Float64, Float64)",
+	"Ring":            "Array(Point)",
+	"LineString":      "Array(Point)",
+	"Polygon":         "Array(Ring)",
+	"MultiLineString": "Array(LineString)",
+	"MultiPolygon":    "Array(Polygon)",
+}
+
+// quoted is set for the values nested into arrays / tuples / maps, they are formatted like literals: ['a','b']
+func readNativeColumn(r *nativeReader, typ string, rows int, loc *time.Location, quoted bool) (values []string, nulls []bool, err error) {
+	if rows == 0 {
+		return []string{}, nil, nil
+	}
+	if alias, ok := nativeTypeAliases[typ]; ok {
+		typ = alias
+	}
+
+	switch {
+	case strings.HasPrefix(typ, "Nullable("):
+		mask, err2 := r.readBytes(rows)
+		if err2 != nil {
+			return nil, nil, err2
+		}
+		values, _, err = readNativeColumn(r, typeParameters(typ), rows, loc, quoted)
+		if err != nil {
+			return
+		}
+		nulls = make([]bool, rows)
+		for idx, isNull := range mask {
+			if isNull != 0 {
+				nulls[idx] = true
+				values[idx] = "NULL"
+			}
+		}
+
+	case strings.HasPrefix(typ, "LowCardinality("):
+		values, nulls, err = readNativeLowCardinalityColumn(r, typeParameters(typ), rows, loc, quoted)
+
+	case strings.HasPrefix(typ, "Array("):
+		offsets, err2 := readNativeOffsets(r, rows)
+		if err2 != nil {
+			return nil, nil, err2
+		}
+		elements, _, err2 := readNativeColumn(r, typeParameters(typ), int(offsets[rows-1]), loc, true)
+		if err2 != nil {
+			return nil, nil, err2
+		}
+		values = make([]string, rows)
+		var prev uint64
+		for idx, offset := range offsets {
+			values[idx] = "[" + strings.Join(elements[prev:offset], ",") + "]"
+			prev = offset
+		}
+
+	case strings.HasPrefix(typ, "Map("):
+		params := splitTypeParameters(typeParameters(typ))
+		if len(params) != 2 {
+			return nil, nil, fmt.Errorf("Bad Map type: %s", typ)
+		}
+		offsets, err2 := readNativeOffsets(r, rows)
+		if err2 != nil {
+			return nil, nil, err2
+		}
+		total := int(offsets[rows-1])
+		keys, _, err2 := readNativeColumn(r, params[0], total, loc, true)
+		if err2 != nil {
+			return nil, nil, err2
+		}
+		mapValues, _, err2 := readNativeColumn(r, params[1], total, loc, true)
+		if err2 != nil {
+			return nil, nil, err2
+		}
+		values = make([]string, rows)
+		var prev uint64
+		for idx, offset := range offsets {
+			pairs := make([]string, 0, offset-prev)
+			for i := prev; i < offset; i++ {
+				pairs = append(pairs, keys[i]+":"+mapValues[i])
+			}
+			values[idx] = "{" + strings.Join(pairs, ",") + "}"
+			prev = offset
+		}
+
+	case strings.HasPrefix(typ, "Tuple("):
+		elements := splitTypeParameters(typeParameters(typ))
+		columns := make([][]string, len(elements))
+		for idx, element := range elements {
+			columns[idx], _, err = readNativeColumn(r, stripTupleElementName(element), rows, loc, true)
+			if err != nil {
+				return
+			}
+		}
+		values = make([]string, rows)
+		for row := range values {
+			parts := make([]string, len(columns))
+			for idx := range columns {
+				parts[idx] = columns[idx][row]
+			}
+			values[row] = "(" + strings.Join(parts, ",") + ")"
+		}
+
+	case strings.HasPrefix(typ, "SimpleAggregateFunction("):
+		params := splitTypeParameters(typeParameters(typ))
+		values, nulls, err = readNativeColumn(r, params[len(params)-1], rows, loc, quoted)
+
+	default:
+		values, err = readNativeScalarColumn(r, typ, rows, loc, quoted)
+	}
+	return
+}
+
+func readNativeOffsets(r *nativeReader, rows int) ([]uint64, error) {
+	buf, err := r.readBytes(rows * 8)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make([]uint64, rows)
+	for idx := range offsets {
+		offsets[idx] = binary.LittleEndian.Uint64(buf[idx*8:])
+	}
+	return offsets, nil
+}
+
+// normally server converts LowCardinality to usual columns for us (see nativeSettings),
+// but some versions ignore low_cardinality_allow_in_native_format
+func readNativeLowCardinalityColumn(r *nativeReader, typ string, rows int, loc *time.Location, quoted bool) (values []string, nulls []bool, err error) {
+	const (
+		needGlobalDictionaryBit = 1 << 8
+		hasAdditionalKeysBit    = 1 << 9
+	)
+
+	version, err := r.readUint64()
+	if err != nil {
+		return
+	}
+	if version != 1 {
+		return nil, nil, fmt.Errorf("Unsupported LowCardinality serialization version %d", version)
+	}
+
+	serializationType, err := r.readUint64()
+	if err != nil {
+		return
+	}
+	if serializationType&needGlobalDictionaryBit != 0 || serializationType&hasAdditionalKeysBit == 0 {
+		return nil, nil, fmt.Errorf("Unsupported LowCardinality serialization type %d", serializationType)
+	}
+
+	// for LowCardinality(Nullable(T)) dictionary has type T and NULL is stored as key 0
+	isNullable := strings.HasPrefix(typ, "Nullable(")
+	if isNullable {
+		typ = typeParameters(typ)
+	}
+
+	numKeys, err := r.readUint64()
+	if err != nil {
+		return
+	}
+	dictionary, _, err := readNativeColumn(r, typ, int(numKeys), loc, quoted)
+	if err != nil {
+		return
+	}
+
+	numIndices, err := r.readUint64()
+	if err != nil {
+		return
+	}
+	if int(numIndices) != rows {
+		return nil, nil, fmt.Errorf("LowCardinality column has %d indices for %d rows", numIndices, rows)
+	}
+
+	keySize := 1 << (serializationType & 0xff)
+	buf, err := r.readBytes(rows * keySize)
+	if err != nil {
+		return
+	}
+
+	values = make([]string, rows)
+	if isNullable {
+		nulls = make([]bool, rows)
+	}
+	for row := range values {
+		var key uint64
+		switch keySize {
+		case 1:
+			key = uint64(buf[row])
+		case 2:
+			key = uint64(binary.LittleEndian.Uint16(buf[row*2:]))
+		case 4:
+			key = uint64(binary.LittleEndian.Uint32(buf[row*4:]))
+		default:
+			key = binary.LittleEndian.Uint64(buf[row*8:])
+		}
+		if key >= numKeys {
+			return nil, nil, fmt.Errorf("LowCardinality key %d is out of dictionary", key)
+		}
+		if isNullable && key == 0 {
+			nulls[row] = true
+			values[row] = "NULL"
+		} else {
+			values[row] = dictionary[key]
+		}
+	}
+	return
+}
+
+func readNativeFixedColumn(r *nativeReader, size, rows int, format func([]byte) string) ([]string, error) {
+	buf, err := r.readBytes(size * rows)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, rows)
+	for idx := range values {
+		values[idx] = format(buf[idx*size : (idx+1)*size])
+	}
+	return values, nil
+}
+
+func readNativeScalarColumn(r *nativeReader, typ string, rows int, loc *time.Location, quoted bool) ([]string, error) {
+	quote := func(s string) string {
+		if quoted {
+			return quoteString(s)
+		}
+		return s
+	}
+
+	switch typ {
+	case "UInt8":
+		return readNativeFixedColumn(r, 1, rows, func(b []byte) string { return strconv.FormatUint(uint64(b[0]), 10) })
+	case "UInt16":
+		return readNativeFixedColumn(r, 2, rows, func(b []byte) string { return strconv.FormatUint(uint64(binary.LittleEndian.Uint16(b)), 10) })
+	case "UInt32":
+		return readNativeFixedColumn(r, 4, rows, func(b []byte) string { return strconv.FormatUint(uint64(binary.LittleEndian.Uint32(b)), 10) })
+	case "UInt64":
+		return readNativeFixedColumn(r, 8, rows, func(b []byte) string { return strconv.FormatUint(binary.LittleEndian.Uint64(b), 10) })
+	case "Int8":
+		return readNativeFixedColumn(r, 1, rows, func(b []byte) string { return strconv.FormatInt(int64(int8(b[0])), 10) })
+	case "Int16":
+		return readNativeFixedColumn(r, 2, rows, func(b []byte) string { return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(b))), 10) })
+	case "Int32":
+		return readNativeFixedColumn(r, 4, rows, func(b []byte) string { return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(b))), 10) })
+	case "Int64", "IntervalNanosecond", "IntervalMicrosecond", "IntervalMillisecond", "IntervalSecond", "IntervalMinute", "IntervalHour", "IntervalDay", "IntervalWeek", "IntervalMonth", "IntervalQuarter", "IntervalYear":
+		return readNativeFixedColumn(r, 8, rows, func(b []byte) string { return strconv.FormatInt(int64(binary.LittleEndian.Uint64(b)), 10) })
+	case "UInt128", "UInt256", "Int128", "Int256":
+		size := 16
+		if strings.HasSuffix(typ, "256") {
+			size = 32
+		}
+		signed := strings.HasPrefix(typ, "Int")
+		return readNativeFixedColumn(r, size, rows, func(b []byte) string { return littleEndianBigInt(b, signed).String() })
+	case "Float32":
+		return readNativeFixedColumn(r, 4, rows, func(b []byte) string {
+			return formatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), 32)
+		})
+	case "Float64":
+		return readNativeFixedColumn(r, 8, rows, func(b []byte) string { return formatFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)), 64) })
+	case "Bool":
+		return readNativeFixedColumn(r, 1, rows, func(b []byte) string { return strconv.FormatBool(b[0] != 0) })
+	case "Nothing":
+		return readNativeFixedColumn(r, 1, rows, func(b []byte) string { return "NULL" })
+	case "String":
+		values := make([]string, rows)
+		for idx := range values {
+			s, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			values[idx] = quote(s)
+		}
+		return values, nil
+	case "Date":
+		return readNativeFixedColumn(r, 2, rows, func(b []byte) string {
+			return quote(time.Unix(int64(binary.LittleEndian.Uint16(b))*86400, 0).UTC().Format("2006-01-02"))
+		})
+	case "Date32":
+		return readNativeFixedColumn(r, 4, rows, func(b []byte) string {
+			return quote(time.Unix(int64(int32(binary.LittleEndian.Uint32(b)))*86400, 0).UTC().Format("2006-01-02"))
+		})
+	case "DateTime":
+		return readNativeFixedColumn(r, 4, rows, func(b []byte) string {
+			return quote(time.Unix(int64(binary.LittleEndian.Uint32(b)), 0).In(loc).Format("2006-01-02 15:04:05"))
+		})
+	case "UUID":
+		// stored as two little-endian UInt64 halves
+		return readNativeFixedColumn(r, 16, rows, func(b []byte) string {
+			u := make([]byte, 16)
+			for i := 0; i < 8; i++ {
+				u[i] = b[7-i]
+				u[8+i] = b[15-i]
+			}
+			s := hex.EncodeToString(u)
+			return quote(s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:])
+		})
+	case "IPv4":
+		return readNativeFixedColumn(r, 4, rows, func(b []byte) string {
+			return quote(net.IPv4(b[3], b[2], b[1], b[0]).String())
+		})
+	case "IPv6":
+		return readNativeFixedColumn(r, 16, rows, func(b []byte) string {
+			ip := net.IP(b)
+			if ip4 := ip.To4(); ip4 != nil {
+				return quote("::ffff:" + ip4.String())
+			}
+			return quote(ip.String())
+		})
+	}
+
+	switch {
+	case strings.HasPrefix(typ, "FixedString("):
+		size, err := strconv.Atoi(typeParameters(typ))
+		if err != nil {
+			return nil, fmt.Errorf("Bad FixedString type: %s", typ)
+		}
+		return readNativeFixedColumn(r, size, rows, func(b []byte) string { return quote(string(b)) })
+
+	case strings.HasPrefix(typ, "DateTime("):
+		columnLoc := loc
+		if tz, err := time.LoadLocation(unquoteString(typeParameters(typ))); err == nil {
+			columnLoc = tz
+		}
+		return readNativeFixedColumn(r, 4, rows, func(b []byte) string {
+			return quote(time.Unix(int64(binary.LittleEndian.Uint32(b)), 0).In(columnLoc).Format("2006-01-02 15:04:05"))
+		})
+
+	case strings.HasPrefix(typ, "DateTime64("):
+		params := splitTypeParameters(typeParameters(typ))
+		precision, err := strconv.Atoi(params[0])
+		if err != nil {
+			return nil, fmt.Errorf("Bad DateTime64 type: %s", typ)
+		}
+		columnLoc := loc
+		if len(params) > 1 {
+			if tz, err := time.LoadLocation(unquoteString(params[1])); err == nil {
+				columnLoc = tz
+			}
+		}
+		scale := int64(math.Pow10(precision))
+		return readNativeFixedColumn(r, 8, rows, func(b []byte) string {
+			ticks := int64(binary.LittleEndian.Uint64(b))
+			sec, frac := ticks/scale, ticks%scale
+			if frac < 0 {
+				sec--
+				frac += scale
+			}
+			s := time.Unix(sec, 0).In(columnLoc).Format("2006-01-02 15:04:05")
+			if precision > 0 {
+				s += fmt.Sprintf(".%0*d", precision, frac)
+			}
+			return quote(s)
+		})
+
+	case strings.HasPrefix(typ, "Enum8("), strings.HasPrefix(typ, "Enum16("):
+		names, err := parseEnumValues(typeParameters(typ))
+		if err != nil {
+			return nil, fmt.Errorf("Bad Enum type: %s", typ)
+		}
+		if strings.HasPrefix(typ, "Enum8(") {
+			return readNativeFixedColumn(r, 1, rows, func(b []byte) string { return quote(names[int64(int8(b[0]))]) })
+		}
+		return readNativeFixedColumn(r, 2, rows, func(b []byte) string { return quote(names[int64(int16(binary.LittleEndian.Uint16(b)))]) })
+
+	case strings.HasPrefix(typ, "Decimal"):
+		precision, scale, err := parseDecimalType(typ)
+		if err != nil {
+			return nil, err
+		}
+		size := 32
+		switch {
+		case precision <= 9:
+			size = 4
+		case precision <= 18:
+			size = 8
+		case precision <= 38:
+			size = 16
+		}
+		return readNativeFixedColumn(r, size, rows, func(b []byte) string { return formatDecimal(littleEndianBigInt(b, true), scale) })
+	}
+
+	return nil, fmt.Errorf("Type %s is not supported by native protocol client", typ)
+}
+
+func littleEndianBigInt(b []byte, signed bool) *big.Int {
+	bigEndian := make([]byte, len(b))
+	for i := range b {
+		bigEndian[len(b)-1-i] = b[i]
+	}
+	v := new(big.Int).SetBytes(bigEndian)
+	if signed && len(b) > 0 && b[len(b)-1]&0x80 != 0 {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	return v
+}
+
+func formatDecimal(v *big.Int, scale int) string {
+	sign := ""
+	if v.Sign() < 0 {
+		sign = "-"
+		v = new(big.Int).Neg(v)
+	}
+	digits := v.String()
+	if scale == 0 {
+		return sign + digits
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+func formatFloat(v float64, bitSize int) string {
+	switch {
+	case math.IsNaN(v):
+		return "nan"
+	case math.IsInf(v, 1):
+		return "inf"
+	case math.IsInf(v, -1):
+		return "-inf"
+	case v == 0 || (math.Abs(v) >= 1e-4 && math.Abs(v) < 1e21):
+		return strconv.FormatFloat(v, 'f', -1, bitSize)
+	}
+	return strconv.FormatFloat(v, 'g', -1, bitSize)
+}
+
+// Decimal(P, S), Decimal32(S), Decimal64(S), Decimal128(S), Decimal256(S)
+func parseDecimalType(typ string) (precision, scale int, err error) {
+	params := splitTypeParameters(typeParameters(typ))
+	switch {
+	case strings.HasPrefix(typ, "Decimal(") && len(params) == 2:
+		if precision, err = strconv.Atoi(params[0]); err == nil {
+			scale, err = strconv.Atoi(params[1])
+		}
+	case len(params) == 1:
+		precisions := map[string]int{"Decimal32": 9, "Decimal64": 18, "Decimal128": 38, "Decimal256": 76}
+		precision = precisions[typ[:strings.Index(typ, "(")]]
+		scale, err = strconv.Atoi(params[0])
+	default:
+		err = fmt.Errorf("Bad Decimal type: %s", typ)
+	}
+	if err == nil && precision == 0 {
+		err = fmt.Errorf("Bad Decimal type: %s", typ)
+	}
+	return
+}
+
+// 'a' = 1, 'b' = 2
+func parseEnumValues(params string) (map[int64]string, error) {
+	names := make(map[int64]string)
+	for _, element := range splitTypeParameters(params) {
+		eqPos := strings.LastIndex(element, "=")
+		if eqPos < 0 {
+			return nil, fmt.Errorf("Bad Enum element: %s", element)
+		}
+		value, err := strconv.ParseInt(strings.TrimSpace(element[eqPos+1:]), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		names[value] = unquoteString(strings.TrimSpace(element[:eqPos]))
+	}
+	return names, nil
+}
+
+// Array(UInt8) => UInt8
+func typeParameters(typ string) string {
+	start := strings.Index(typ, "(")
+	if start < 0 || !strings.HasSuffix(typ, ")") {
+		return ""
+	}
+	return typ[start+1 : len(typ)-1]
+}
+
+// splits by commas on the top level (not inside parentheses or quotes)
+func splitTypeParameters(params string) []string {
+	var res []string
+	depth := 0
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(params); i++ {
+		switch c := params[i]; {
+		case inQuotes && c == '\\':
+			i++
+		case c == '\'':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			res = append(res, strings.TrimSpace(params[start:i]))
+			start = i + 1
+		}
+	}
+	if tail := strings.TrimSpace(params[start:]); len(tail) > 0 {
+		res = append(res, tail)
+	}
+	return res
+}
+
+// named tuples look like Tuple(a String, b UInt8)
+func stripTupleElementName(element string) string {
+	spacePos := strings.Index(element, " ")
+	parenPos := strings.Index(element, "(")
+	if spacePos > 0 && (parenPos < 0 || spacePos < parenPos) {
+		return strings.TrimSpace(element[spacePos+1:])
+	}
+	return element
+}
+
+// escaping used for TabSeparated format and for quoted literals
+var stringEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	"\b", "\\b",
+	"\f", "\\f",
+	"\r", "\\r",
+	"\n", "\\n",
+	"\t", "\\t",
+	"\x00", "\\0",
+	"'", "\\'",
+)
+var stringUnquoter = strings.NewReplacer("\\\\", "\\", "\\'", "'")
+
+func escapeString(s string) string {
+	return stringEscaper.Replace(s)
+}
+
+func quoteString(s string) string {
+	return "'" + escapeString(s) + "'"
+}
+
+func unquoteString(s string) string {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return stringUnquoter.Replace(s[1 : len(s)-1])
+	}
+	return s
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// helpers to build the column data in Native format
+func nativeUint64(values ...uint64) []byte {
+	buf := make([]byte, 8*len(values))
+	for idx, v := range values {
+		binary.LittleEndian.PutUint64(buf[idx*8:], v)
+	}
+	return buf
+}
+
+func nativeStrings(values ...string) []byte {
+	var buf []byte
+	for _, s := range values {
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	return buf
+}
+
+func nativeData(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func newTestNativeReader(data []byte) *nativeReader {
+	return &nativeReader{rd: bufio.NewReader(bytes.NewReader(data))}
+}
+
+func TestReadNativeColumn(t *testing.T) {
+	tests := []struct {
+		typ    string
+		rows   int
+		data   []byte
+		values []string
+		nulls  []bool
+	}{
+		{"UInt8", 2, []byte{1, 255}, []string{"1", "255"}, nil},
+		{"Int16", 1, []byte{0xff, 0xff}, []string{"-1"}, nil},
+		{"Int128", 1, bytes.Repeat([]byte{0xff}, 16), []string{"-1"}, nil},
+		{"Float64", 1, nativeUint64(0x7ff8000000000001), []string{"nan"}, nil},
+		{"Float32", 1, []byte{0xac, 0xc5, 0x27, 0x37}, []string{"1e-05"}, nil},
+		{"Bool", 2, []byte{0, 1}, []string{"false", "true"}, nil},
+		{"String", 2, nativeStrings("a", "it's"), []string{"a", "it's"}, nil},
+		{"FixedString(2)", 1, []byte("ab"), []string{"ab"}, nil},
+		{"Date", 1, []byte{1, 0}, []string{"1970-01-02"}, nil},
+		{"DateTime('UTC')", 1, []byte{0x10, 0x0e, 0, 0}, []string{"1970-01-01 01:00:00"}, nil},
+		{"DateTime64(3, 'UTC')", 1, nativeUint64(^uint64(0)), []string{"1969-12-31 23:59:59.999"}, nil},
+		{"Decimal(9, 2)", 1, []byte{0xc7, 0xcf, 0xff, 0xff}, []string{"-123.45"}, nil},
+		{"Decimal64(4)", 1, nativeUint64(5), []string{"0.0005"}, nil},
+		{"Enum8('a' = 1, 'b' = -1)", 2, []byte{1, 0xff}, []string{"a", "b"}, nil},
+		{"IPv4", 1, []byte{1, 0, 0, 127}, []string{"127.0.0.1"}, nil},
+		{
+			"UUID", 1,
+			[]byte{0xef, 0xcd, 0xab, 0x89, 0x67, 0x45, 0x23, 0x01, 0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11, 0x00},
+			[]string{"01234567-89ab-cdef-0011-223344556677"}, nil,
+		},
+		{
+			"Nullable(String)", 2,
+			nativeData([]byte{0, 1}, nativeStrings("a", "")),
+			[]string{"a", "NULL"}, []bool{false, true},
+		},
+		{
+			"Array(String)", 2,
+			nativeData(nativeUint64(1, 3), nativeStrings("a", "b", "it's")),
+			[]string{"['a']", "['b','it\\'s']"}, nil,
+		},
+		{
+			"Array(Nullable(UInt8))", 2,
+			nativeData(nativeUint64(0, 2), []byte{1, 0}, []byte{0, 7}),
+			[]string{"[]", "[NULL,7]"}, nil,
+		},
+		{
+			"Map(String, UInt8)", 1,
+			nativeData(nativeUint64(2), nativeStrings("k1", "k2"), []byte{1, 2}),
+			[]string{"{'k1':1,'k2':2}"}, nil,
+		},
+		{
+			"Tuple(a UInt8, b String)", 1,
+			nativeData([]byte{1}, nativeStrings("x")),
+			[]string{"(1,'x')"}, nil,
+		},
+		{
+			"LowCardinality(Nullable(String))", 3,
+			nativeData(nativeUint64(1, 1<<9, 2), nativeStrings("", "x"), nativeUint64(3), []byte{1, 0, 1}),
+			[]string{"x", "NULL", "x"}, []bool{false, true, false},
+		},
+	}
+	for _, test := range tests {
+		r := newTestNativeReader(test.data)
+		values, nulls, err := readNativeColumn(r, test.typ, test.rows, time.UTC, false)
+		if err != nil {
+			t.Errorf("readNativeColumn(%s): %v", test.typ, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.values) || !reflect.DeepEqual(nulls, test.nulls) {
+			t.Errorf("readNativeColumn(%s) = %q, %v, want %q, %v", test.typ, values, nulls, test.values, test.nulls)
+		}
+		if _, err := r.rd.ReadByte(); err == nil {
+			t.Errorf("readNativeColumn(%s) didn't read all the data", test.typ)
+		}
+	}
+
+	for _, typ := range []string{"Object('json')", "LowCardinality(String)"} {
+		if _, _, err := readNativeColumn(newTestNativeReader(nativeUint64(2, 0)), typ, 1, time.UTC, false); err == nil {
+			t.Errorf("readNativeColumn(%s): expected an error", typ)
+		}
+	}
+}
+
+func TestNativeBlockStringRows(t *testing.T) {
+	data := nativeData(
+		[]byte{2, 2}, // columns, rows
+		nativeStrings("n", "Nullable(UInt8)"), []byte{0, 1}, []byte{5, 0},
+		nativeStrings("s", "String"), nativeStrings("a", "b"),
+	)
+	block, err := readNativeBlock(newTestNativeReader(data), revisionWithBlockInfo-1, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"5", "a"}, {"\\N", "b"}}
+	if got := block.stringRows(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stringRows() = %q, want %q", got, want)
+	}
+}
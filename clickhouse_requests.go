@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
 	"regexp"
@@ -42,6 +44,9 @@ type progressInfo struct {
 	WrittenRows     uint64
 	WrittenBytes    uint64
 	MemoryUsage     int64
+	// INSERT FROM INFILE
+	UploadedBytes    uint64
+	UploadTotalBytes uint64
 }
 
 type queryStats struct {
@@ -55,17 +60,42 @@ type queryStats struct {
 	MemoryUsage   uint64
 	Exception     string
 	StackTrace    string
+	ServerStats   bool // counters are taken from server, not estimated by client
 }
 
+// cached result of getServerVersion
+var serverVersion string
+
 func getServerVersion() (version string, err error) {
 	data, err := serviceRequest("SELECT version()")
 	if err != nil {
 		return
 	}
 	version = data[0][0]
+	serverVersion = version
 	return
 }
 
+// version is requested lazily if it was not requested before
+func serverVersionAtLeast(major, minor int) bool {
+	if serverVersion == "" {
+		if _, err := getServerVersion(); err != nil {
+			return false
+		}
+	}
+	parts := strings.SplitN(serverVersion, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	serverMajor, err1 := strconv.Atoi(parts[0])
+	serverMinor, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	// old versions looked like 1.1.54343
+	return serverMajor > major || (serverMajor == major && serverMinor >= minor)
+}
+
 func getProgressInfo(queryID string) (pi progressInfo, err error) {
 	pi = progressInfo{}
 	query := fmt.Sprintf("select elapsed,read_rows,read_bytes,total_rows_approx,written_rows,written_bytes,memory_usage from system.processes where query_id='%s'", queryID)
@@ -90,16 +120,22 @@ func getProgressInfo(queryID string) (pi progressInfo, err error) {
 	return
 }
 
+var errQueryStatsNotFound = errors.New("Query is not found in system.query_log")
+
 func getQueryStats(queryID string) (qs queryStats, err error) {
 
-	query := fmt.Sprintf("select query_duration_ms,read_rows,read_bytes,written_rows,written_bytes,result_rows,result_bytes,memory_usage,exception,stack_trace,type from system.query_log where query_id='%s' and type>1", queryID)
+	query := fmt.Sprintf("select query_duration_ms,read_rows,read_bytes,written_rows,written_bytes,result_rows,result_bytes,memory_usage,exception,stack_trace,type from system.query_log where query_id='%s' and toUInt8(type)>1 limit 1", queryID)
 
 	data, err := serviceRequest(query)
 
 	if err != nil {
 		return
 	}
-	if len(data) != 1 || len(data[0]) != 7 {
+	if len(data) == 0 {
+		err = errQueryStatsNotFound
+		return
+	}
+	if len(data) != 1 || len(data[0]) != 11 {
 		err = errors.New("Bad response dimensions")
 		return
 	}
@@ -115,10 +151,109 @@ func getQueryStats(queryID string) (qs queryStats, err error) {
 	qs.MemoryUsage, _ = strconv.ParseUint(data[0][7], 10, 64)
 	qs.Exception = data[0][8]
 	qs.StackTrace = data[0][9]
+	qs.ServerStats = true
+	return
+}
+
+// query_log is flushed periodically (7.5 seconds by default), so the record can appear with a delay
+func waitForQueryStats(queryID string, timeout time.Duration) (qs queryStats, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		qs, err = getQueryStats(queryID)
+		if err != errQueryStatsNotFound || time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func parseSummaryHeader(header string) (qs queryStats, err error) {
+	type SummaryData struct {
+		ReadRows        uint64 `json:"read_rows,string"`
+		ReadBytes       uint64 `json:"read_bytes,string"`
+		WrittenRows     uint64 `json:"written_rows,string"`
+		WrittenBytes    uint64 `json:"written_bytes,string"`
+		ResultRows      uint64 `json:"result_rows,string"`
+		ResultBytes     uint64 `json:"result_bytes,string"`
+		MemoryUsage     uint64 `json:"memory_usage,string"`
+		PeakMemoryUsage uint64 `json:"peak_memory_usage,string"`
+	}
+	var sd SummaryData
+	if err = json.Unmarshal([]byte(header), &sd); err != nil {
+		return
+	}
+	qs = queryStats{
+		ReadRows:     sd.ReadRows,
+		ReadBytes:    sd.ReadBytes,
+		WrittenRows:  sd.WrittenRows,
+		WrittenBytes: sd.WrittenBytes,
+		ResultRows:   sd.ResultRows,
+		ResultBytes:  sd.ResultBytes,
+		MemoryUsage:  sd.MemoryUsage,
+		ServerStats:  true,
+	}
+	if sd.PeakMemoryUsage > 0 {
+		qs.MemoryUsage = sd.PeakMemoryUsage
+	}
 	return
 }
 
+func maxUint64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// summary header can be sent before the query is finished (when the result is streamed),
+// so the counters which were seen later in progress or counted by client can be bigger
+func (qs *queryStats) merge(other queryStats) {
+	qs.ReadRows = maxUint64(qs.ReadRows, other.ReadRows)
+	qs.ReadBytes = maxUint64(qs.ReadBytes, other.ReadBytes)
+	qs.WrittenRows = maxUint64(qs.WrittenRows, other.WrittenRows)
+	qs.WrittenBytes = maxUint64(qs.WrittenBytes, other.WrittenBytes)
+	qs.ResultBytes = maxUint64(qs.ResultBytes, other.ResultBytes)
+	qs.MemoryUsage = maxUint64(qs.MemoryUsage, other.MemoryUsage)
+	qs.ServerStats = qs.ServerStats || other.ServerStats
+	if qs.ResultRows == 0 {
+		qs.ResultRows = other.ResultRows
+	}
+}
+
+// in the style of clickhouse-client
+func formatQueryStats(qs queryStats) string {
+	seconds := qs.QueryDuration.Seconds()
+	res := fmt.Sprintf("%v rows in set. Elapsed: %.3f sec.", qs.ResultRows, seconds)
+	if qs.ReadRows > 0 || qs.ReadBytes > 0 {
+		res += fmt.Sprintf(" Processed %s rows, %s", formatReadableQuantity(float64(qs.ReadRows)), formatReadableSizeWithDecimalSuffix(float64(qs.ReadBytes)))
+		if seconds > 0 {
+			res += fmt.Sprintf(" (%s rows/s., %s/s.)", formatReadableQuantity(float64(qs.ReadRows)/seconds), formatReadableSizeWithDecimalSuffix(float64(qs.ReadBytes)/seconds))
+		}
+	}
+
+	var details []string
+	if qs.WrittenRows > 0 || qs.WrittenBytes > 0 {
+		details = append(details, fmt.Sprintf("Written %s rows, %s.", formatReadableQuantity(float64(qs.WrittenRows)), formatReadableSizeWithDecimalSuffix(float64(qs.WrittenBytes))))
+	}
+	if qs.ResultBytes > 0 {
+		details = append(details, fmt.Sprintf("Result %s.", formatReadableSizeWithDecimalSuffix(float64(qs.ResultBytes))))
+	}
+	if qs.MemoryUsage > 0 {
+		details = append(details, fmt.Sprintf("Peak memory usage: %s.", formatReadableSizeWithDecimalSuffix(float64(qs.MemoryUsage))))
+	}
+	if len(details) > 0 {
+		res += "\n" + strings.Join(details, " ")
+	}
+	return res
+}
+
+// stdin can be read only once: it's either a script in multiquery mode or the data for the first query
+var stdinConsumed = false
+
 func hasDataInStdin() bool {
+	if stdinConsumed {
+		return false
+	}
 	fi, err := os.Stdin.Stat()
 	if err == nil {
 		if fi.Mode()&os.ModeNamedPipe != 0 {
@@ -130,11 +265,9 @@ func hasDataInStdin() bool {
 
 var useCmdRegexp = regexp.MustCompile("^\\s*(?i)use\\s+(\"\\w+\"|\\w+|`\\w+`)\\s*$")
 
-// it will not match SET GLOBAL as set global not affect current session, according to docs
-var setCmdRegexp = regexp.MustCompile("^\\s*(?i)set\\s+(?:\"\\w+\"|\\w+|\\`\\w+\\`)\\s*=\\s*(?:'([^']+)'|[0-9]+|NULL)")
-var settingsRegexp = regexp.MustCompile("\\s*(\"\\w+\"|\\w+|\\`\\w+\\`)\\s*=\\s*('[^']+'|[0-9]+|NULL)\\s*,?")
-
-func fireQuery(sqlToExequte, format string, interactive bool) {
+// returns http status of the query, or -1 if it was not sent at all or failed on the client side,
+// and the error (exception from the server or client-side one) if the query failed
+func fireQuery(sqlToExequte, format string, interactive bool) (int, error) {
 
 	signalCh := make(chan os.Signal, 1)
 
@@ -154,34 +287,63 @@ func fireQuery(sqlToExequte, format string, interactive bool) {
 		}
 	}()
 
+	res := -1
+	err := errOutputSetup
 	if chcOutput.setupOutput(cancel) {
-		res := queryToStdout(cx, sqlToExequte, format, interactive)
+		res, err = queryToStdout(cx, sqlToExequte, format, interactive)
 		if res == 200 {
 			useCmdMatches := useCmdRegexp.FindStringSubmatch(sqlToExequte)
 			if useCmdMatches != nil {
 				opts.Database = strings.Trim(useCmdMatches[1], "\"`")
 				chcOutput.printServiceMsg("Database changed to " + opts.Database + "\n")
 			}
-			if setCmdRegexp.MatchString(sqlToExequte) {
-				settings := sqlToExequte[4:]
-				settingsMatched := settingsRegexp.FindAllStringSubmatch(settings, -1)
-				for _, match := range settingsMatched {
-					clickhouseSetting[strings.Trim(match[1], "\"`")] = strings.Trim(match[2], "'")
-				}
-				// spew.Dump(clickhouseSetting)
+			// it will not match SET GLOBAL as set global not affect current session, according to docs
+			for name, value := range parseSetQuery(sqlToExequte) {
+				clickhouseSetting[name] = value
+			}
+			if interactive {
+				refreshAutocomplete(sqlToExequte)
 			}
 
 		}
 		queryFinished <- true
 	}
+	return res, err
+}
+
+// multiquery mode: script (from --query or stdin) is splitted into statements which are executed one by one
+// execution stops on the first failed statement unless --ignore-error is set. Returns the error of the last failed one
+func fireQueries(script, format string) error {
+	if len(script) == 0 && hasDataInStdin() {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			chcOutput.printServiceMsg(fmt.Sprintf("Unable to read stdin: %s\n", err))
+			return err
+		}
+		stdinConsumed = true
+		script = string(data)
+	}
+
+	var lastErr error
+	for _, query := range splitQueries(script) {
+		echoQuery(query)
+		if _, err := fireQuery(query, format, false); err != nil {
+			lastErr = err
+			if !opts.IgnoreErr {
+				break
+			}
+		}
+	}
+	return lastErr
 }
 
 const (
-	dataPacket     = iota
-	errPacket      = iota
-	donePacket     = iota
-	statusPacket   = iota
-	progressPacket = iota
+	dataPacket      = iota
+	errPacket       = iota
+	donePacket      = iota
+	statusPacket    = iota
+	progressPacket  = iota
+	exceptionPacket = iota // exception from the server, Err contains *serverException
 )
 
 type queryExecution struct {
@@ -193,11 +355,12 @@ type queryExecution struct {
 	PacketType int
 }
 
-func queryToStdout(cx context.Context, query, format string, interactive bool) int {
+func queryToStdout(cx context.Context, query, format string, interactive bool) (status int, err error) {
 	queryID := get_id()
 	defer chcOutput.releaseOutput()
 
-	status := -1
+	status = -1
+	reconnected := false
 
 	initProgress()
 
@@ -213,17 +376,62 @@ Loop2:
 				clearProgress(chcOutput.StdErr)
 				io.WriteString(chcOutput.StdOut, data)
 			case errPacket:
-				log.Fatalln(qe.Err)
+				clearProgress(chcOutput.StdErr)
+				chcOutput.finishOutput()
+				// if server was not reachable the query was not executed, so it's safe to repeat it
+				if interactive && !reconnected && isConnectionError(qe.Err) {
+					reconnected = true
+					chcOutput.printServiceMsg(fmt.Sprintf("\nConnection error: %s\nReconnecting...\n", qe.Err))
+					if reconnect(cx) {
+						if status == -1 && isConnectError(qe.Err) {
+							chcOutput.printServiceMsg("Reconnected, repeating the query.\n")
+							initProgress()
+							queryExecutionChannel = makeQuery(cx, query, queryID, format, interactive)
+							continue
+						}
+						chcOutput.printServiceMsg("Reconnected. The query was not repeated as it could be already executed.\n\n")
+					} else {
+						chcOutput.printServiceMsg("Unable to reconnect.\n\n")
+					}
+				} else {
+					chcOutput.printServiceMsg(fmt.Sprintf("\nError: %s\n\n", qe.Err))
+				}
+				status = -1
+				err = qe.Err
+				break Loop2
+			case exceptionPacket:
+				err = qe.Err
+				clearProgress(chcOutput.StdErr)
+				chcOutput.finishOutput()
+				if exception, ok := qe.Err.(*serverException); ok {
+					chcOutput.printServiceMsg(exception.render())
+				} else {
+					chcOutput.printServiceMsg(fmt.Sprintf("\nReceived exception from server:\n%s\n", qe.Err))
+				}
+				// exception can come in the middle of the data, after the status was already received
+				if status == 200 {
+					status = 500
+				}
 			case donePacket:
-				count := qe.Stats.ResultRows
-				duration := qe.Stats.QueryDuration
+				stats := qe.Stats
 				clearProgress(chcOutput.StdErr)
-				if opts.Time {
+				chcOutput.finishOutput()
+				switch {
+				case interactive:
 					if status == 200 {
-						chcOutput.printServiceMsg(fmt.Sprintf("\n%v rows in set. Elapsed: %v\n\n", count, duration))
+						// with --stats-wait 0 query_log is checked once
+						if !stats.ServerStats {
+							if logStats, err := waitForQueryStats(queryID, time.Duration(opts.StatsWait)*time.Second); err == nil {
+								stats.merge(logStats)
+							}
+						}
+						chcOutput.printServiceMsg("\n" + formatQueryStats(stats) + "\n\n")
 					} else {
-						chcOutput.printServiceMsg(fmt.Sprintf("\nElapsed: %v\n\n", duration))
+						chcOutput.printServiceMsg(fmt.Sprintf("\nElapsed: %.3f sec.\n\n", stats.QueryDuration.Seconds()))
 					}
+				case opts.Time:
+					// machine-parsable: just seconds, one line per query (same as clickhouse-client)
+					chcOutput.printServiceMsg(fmt.Sprintf("%.3f\n", stats.QueryDuration.Seconds()))
 				}
 				break Loop2
 			case statusPacket:
@@ -233,10 +441,16 @@ Loop2:
 				}
 			case progressPacket:
 				pi := qe.Progress
-				writeProgres(chcOutput.StdErr, pi.ReadRows, pi.ReadBytes, pi.TotalRowsApprox, uint64(pi.Elapsed*1000000000))
+				if pi.UploadTotalBytes > 0 {
+					writeUploadProgress(chcOutput.StdErr, pi.UploadedBytes, pi.UploadTotalBytes, uint64(pi.Elapsed*1000000000))
+				} else {
+					writeProgres(chcOutput.StdErr, pi.ReadRows, pi.ReadBytes, pi.TotalRowsApprox, uint64(pi.Elapsed*1000000000))
+				}
 			}
 		case <-cx.Done():
 			clearProgress(chcOutput.StdErr)
+			chcOutput.finishOutput()
+			err = cx.Err()
 			chcOutput.printServiceMsg(fmt.Sprintf("\nKilling query (id: %v)... ", queryID))
 			if killQuery(queryID) {
 				chcOutput.printServiceMsg("killed!\n\n")
@@ -246,6 +460,28 @@ Loop2:
 			break Loop2
 		}
 	}
-	return status
+	return
 	// io.WriteString(stdErr, "queryToStdout finished" );
 }
+
+// in batch mode with --echo the query is printed before execution
+func echoQuery(query string) {
+	if opts.Echo {
+		chcOutput.printServiceMsg(query + "\n")
+	}
+}
+
+var errOutputSetup = errors.New("Unable to setup output")
+
+const reconnectTimeout = 30 * time.Second
+
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// connection was not established, so nothing was sent to the server
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
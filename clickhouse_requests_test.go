@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestConnectionErrors(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	tests := []struct {
+		err        error
+		connection bool
+		connect    bool
+	}{
+		{dialErr, true, true},
+		{&url.Error{Op: "Post", URL: "http://localhost:8123", Err: dialErr}, true, true},
+		{readErr, true, false},
+		{fmt.Errorf("reading: %w", io.EOF), true, false},
+		{io.ErrUnexpectedEOF, true, false},
+		{errors.New("Code: 62. DB::Exception: Syntax error"), false, false},
+		{nil, false, false},
+	}
+	for _, test := range tests {
+		if got := isConnectionError(test.err); got != test.connection {
+			t.Errorf("isConnectionError(%v) = %v, want %v", test.err, got, test.connection)
+		}
+		if got := isConnectError(test.err); got != test.connect {
+			t.Errorf("isConnectError(%v) = %v, want %v", test.err, got, test.connect)
+		}
+	}
+}
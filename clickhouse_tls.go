@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+)
+
+// shared by all the requests to the server (queries, progress, kill, autocomplete)
+var httpClient = http.DefaultClient
+
+var tlsConfig *tls.Config
+
+func hasTLSOptions() bool {
+	return len(opts.CACert) > 0 || len(opts.ClientCert) > 0 || len(opts.ClientKey) > 0 || len(opts.TLSServerName) > 0 || opts.Insecure
+}
+
+func makeTLSConfig() (*tls.Config, error) {
+	// without ServerName the host of the current replica is verified
+	config := &tls.Config{ServerName: opts.TLSServerName, InsecureSkipVerify: opts.Insecure}
+
+	if len(opts.CACert) > 0 {
+		pem, err := ioutil.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + opts.CACert)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(opts.ClientCert) > 0 || len(opts.ClientKey) > 0 {
+		if len(opts.ClientCert) == 0 || len(opts.ClientKey) == 0 {
+			return nil, errors.New("Both --client-cert and --client-key should be specified")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func setupHTTPClient() error {
+	if opts.Protocol != "https" {
+		if hasTLSOptions() {
+			chcOutput.printServiceMsg("TLS options are ignored for protocol " + opts.Protocol + "\n")
+		}
+		return nil
+	}
+
+	config, err := makeTLSConfig()
+	if err != nil {
+		return err
+	}
+	tlsConfig = config
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	httpClient = &http.Client{Transport: transport}
+	return nil
+}
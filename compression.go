@@ -0,0 +1,151 @@
+package main
+
+// Compression of http traffic (--compression): the server is asked to compress the responses
+// (enable_http_compression + Accept-Encoding), and data sent in the body of INSERT queries is compressed
+// with Content-Encoding. The same writers are used for INTO OUTFILE.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// values of --compression, mapped to Content-Encoding
+var httpCompressions = map[string]string{
+	"gzip":   "gzip",
+	"gz":     "gzip",
+	"zstd":   "zstd",
+	"zst":    "zstd",
+	"br":     "br",
+	"brotli": "br",
+	"lz4":    "lz4",
+}
+
+// empty for none
+func parseHTTPCompression(name string) (string, error) {
+	name = strings.ToLower(name)
+	if len(name) == 0 || name == "none" {
+		return "", nil
+	}
+	if encoding, ok := httpCompressions[name]; ok {
+		return encoding, nil
+	}
+	return "", fmt.Errorf("Unsupported compression method: %s (gzip, zstd, br, lz4 or none)", name)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// the compressed data is flushed on Close, it doesn't close the underlying writer. Level 0 is the default one
+func newCompressingWriter(w io.Writer, method string, level int) (io.WriteCloser, error) {
+	switch method {
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "zstd":
+		if level == 0 {
+			return zstd.NewWriter(w)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	case "br":
+		if level == 0 {
+			level = brotli.DefaultCompression
+		}
+		return brotli.NewWriterLevel(w, level), nil
+	case "lz4":
+		levels := []lz4.CompressionLevel{lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9}
+		if level < 0 || level >= len(levels) {
+			return nil, fmt.Errorf("lz4 compression level should be from 1 to 9, got %d", level)
+		}
+		lw := lz4.NewWriter(w)
+		if err := lw.Apply(lz4.CompressionLevelOption(levels[level])); err != nil {
+			return nil, err
+		}
+		return lw, nil
+	case "":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("Unsupported compression method: %s", method)
+}
+
+// the body is compressed while it's sent, so the request has no Content-Length
+func compressedRequestBody(body io.Reader, method string) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := newCompressingWriter(pw, method, 0)
+		if err == nil {
+			_, err = io.Copy(w, body)
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+func setRequestCompression(req *http.Request, body io.Reader, method string) {
+	req.Body = ioutil.NopCloser(compressedRequestBody(body, method))
+	req.GetBody = nil
+	req.ContentLength = -1
+	req.Header.Set("Content-Encoding", method)
+}
+
+type decompressingBody struct {
+	io.Reader
+	decoder io.Closer
+}
+
+func (body decompressingBody) Close() error {
+	if body.decoder != nil {
+		return body.decoder.Close()
+	}
+	return nil
+}
+
+// reader of the response body decompressed according to Content-Encoding. Closing it releases only
+// the decompressor, response.Body should be closed as usual
+func responseBody(response *http.Response) (io.ReadCloser, error) {
+	encoding := strings.ToLower(response.Header.Get("Content-Encoding"))
+	if len(encoding) == 0 || encoding == "identity" || response.Uncompressed {
+		return decompressingBody{Reader: response.Body}, nil
+	}
+	// compressed body can be empty (for example the response to INSERT), decoders fail on that
+	buffered := bufio.NewReader(response.Body)
+	if _, err := buffered.Peek(1); err == io.EOF {
+		return decompressingBody{Reader: buffered}, nil
+	}
+	switch encoding {
+	case "gzip":
+		gr, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decompressingBody{gr, gr}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		rc := zr.IOReadCloser()
+		return decompressingBody{rc, rc}, nil
+	case "br":
+		return decompressingBody{Reader: brotli.NewReader(buffered)}, nil
+	case "lz4":
+		return decompressingBody{Reader: lz4.NewReader(buffered)}, nil
+	}
+	return nil, fmt.Errorf("Unsupported Content-Encoding of the response: %s", encoding)
+}
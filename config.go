@@ -0,0 +1,257 @@
+package main
+
+// Config file with named connections. Both own yaml format and config.xml of clickhouse-client are understood.
+//
+// ~/.chc/config.yaml:
+//
+//   # top-level values are used as defaults for all connections
+//   user: default
+//   default_connection: local
+//   connections:
+//     local:
+//       host: localhost
+//     prod:
+//       hosts: [ch1.example.com, ch2.example.com]
+//       port: 9000
+//       protocol: native
+//       database: analytics
+//       format: PrettyCompact
+//       pager: less -S -R
+//       compression: zstd
+//       settings:
+//         max_threads: 8
+//
+// ~/.clickhouse-client/config.xml (https://clickhouse.com/docs/en/interfaces/cli#connection-credentials):
+//
+//   <config>
+//     <user>default</user>
+//     <connections_credentials>
+//       <connection>
+//         <name>prod</name>
+//         <hostname>ch1.example.com</hostname>
+//         <port>9000</port>
+//       </connection>
+//     </connections_credentials>
+//   </config>
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+)
+
+type connectionConfig struct {
+	Host        string                 `yaml:"host"`
+	Hosts       []string               `yaml:"hosts"` // replicas, alternative to host
+	Port        uint                   `yaml:"port"`
+	Protocol    string                 `yaml:"protocol"`
+	User        string                 `yaml:"user"`
+	Password    string                 `yaml:"password"`
+	Database    string                 `yaml:"database"`
+	Format      string                 `yaml:"format"`
+	Pager       string                 `yaml:"pager"`
+	Compression string                 `yaml:"compression"`
+	Settings    map[string]interface{} `yaml:"settings"`
+}
+
+type chcConfig struct {
+	Defaults          connectionConfig            `yaml:",inline"`
+	DefaultConnection string                      `yaml:"default_connection"`
+	Connections       map[string]connectionConfig `yaml:"connections"`
+}
+
+// settings passed with each query (from config file and command line)
+var querySettings = make(map[string]string)
+
+func defaultConfigFiles() []string {
+	return []string{
+		filepath.Join(homedir(), ".chc", "config.yaml"),
+		filepath.Join(homedir(), ".chc", "config.yml"),
+		filepath.Join(homedir(), ".clickhouse-client", "config.xml"),
+	}
+}
+
+// returns nil config if file is not specified and none of default files exists
+func loadConfig(filename string) (*chcConfig, error) {
+	if len(filename) == 0 {
+		for _, fn := range defaultConfigFiles() {
+			if _, err := os.Stat(fn); err == nil {
+				filename = fn
+				break
+			}
+		}
+		if len(filename) == 0 {
+			return nil, nil
+		}
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(strings.ToLower(filename), ".xml") {
+		return parseClientXMLConfig(data)
+	}
+
+	cfg := &chcConfig{}
+	if err = yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return cfg, nil
+}
+
+func parseClientXMLConfig(data []byte) (*chcConfig, error) {
+	type xmlConnection struct {
+		Name     string `xml:"name"`
+		Hostname string `xml:"hostname"`
+		Host     string `xml:"host"`
+		Port     string `xml:"port"`
+		User     string `xml:"user"`
+		Password string `xml:"password"`
+		Database string `xml:"database"`
+		Secure   string `xml:"secure"`
+	}
+	type xmlConfig struct {
+		xmlConnection
+		Connections []xmlConnection `xml:"connections_credentials>connection"`
+	}
+
+	var xc xmlConfig
+	if err := xml.Unmarshal(data, &xc); err != nil {
+		return nil, err
+	}
+
+	// port in clickhouse-client config is the port of native protocol
+	convert := func(xconn xmlConnection) (conn connectionConfig, err error) {
+		conn = connectionConfig{Host: xconn.Hostname, User: xconn.User, Password: xconn.Password, Database: xconn.Database}
+		if len(conn.Host) == 0 {
+			conn.Host = xconn.Host
+		}
+		if len(xconn.Port) > 0 {
+			port, err := strconv.ParseUint(strings.TrimSpace(xconn.Port), 10, 16)
+			if err != nil {
+				return conn, fmt.Errorf("Bad port in connection %s: %s", xconn.Name, xconn.Port)
+			}
+			conn.Port = uint(port)
+			conn.Protocol = protocolNative
+		}
+		// native protocol is not encrypted here, so secure connections use https (on the configured port)
+		if secure := strings.TrimSpace(xconn.Secure); secure == "1" || secure == "true" {
+			conn.Protocol = "https"
+		}
+		return
+	}
+
+	cfg := &chcConfig{Connections: make(map[string]connectionConfig)}
+	var err error
+	if cfg.Defaults, err = convert(xc.xmlConnection); err != nil {
+		return nil, err
+	}
+	for _, xconn := range xc.Connections {
+		if cfg.Connections[xconn.Name], err = convert(xconn); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// values of the named connection override the top-level ones
+func (cfg *chcConfig) connection(name string) (conn connectionConfig, err error) {
+	conn = cfg.Defaults
+	if len(name) == 0 {
+		name = cfg.DefaultConnection
+	}
+	if len(name) == 0 {
+		return
+	}
+
+	named, ok := cfg.Connections[name]
+	if !ok {
+		err = fmt.Errorf("Connection %s is not found in config file", name)
+		return
+	}
+
+	override := func(dst *string, src string) {
+		if len(src) > 0 {
+			*dst = src
+		}
+	}
+	if len(named.Host) > 0 || len(named.Hosts) > 0 {
+		conn.Host, conn.Hosts = named.Host, named.Hosts
+	}
+	override(&conn.Protocol, named.Protocol)
+	override(&conn.User, named.User)
+	override(&conn.Password, named.Password)
+	override(&conn.Database, named.Database)
+	override(&conn.Format, named.Format)
+	override(&conn.Pager, named.Pager)
+	override(&conn.Compression, named.Compression)
+	// the port of another protocol is useless
+	if named.Port != 0 || (len(named.Protocol) > 0 && named.Protocol != cfg.Defaults.Protocol) {
+		conn.Port = named.Port
+	}
+	settings := make(map[string]interface{})
+	for k, v := range conn.Settings {
+		settings[k] = v
+	}
+	for k, v := range named.Settings {
+		settings[k] = v
+	}
+	conn.Settings = settings
+	return
+}
+
+// option was passed in command line or environment variable (not just filled with default value)
+func isSetByUser(argsParser *flags.Parser, longName string) bool {
+	option := argsParser.FindOptionByLongName(longName)
+	if option == nil {
+		return false
+	}
+	if envKey := option.EnvKeyWithNamespace(); len(envKey) > 0 {
+		if _, ok := os.LookupEnv(envKey); ok {
+			return true
+		}
+	}
+	return option.IsSet() && !option.IsSetDefault()
+}
+
+// command line options and environment variables have priority over config file.
+// Returns true if the port was taken from the config file
+func applyConnectionConfig(argsParser *flags.Parser, conn connectionConfig) (portSet bool) {
+	setString := func(longName string, dst *string, value string) {
+		if len(value) > 0 && !isSetByUser(argsParser, longName) {
+			*dst = value
+		}
+	}
+	setString("host", &opts.Host, conn.Host)
+	setString("host", &opts.Host, strings.Join(conn.Hosts, ","))
+	setString("user", &opts.User, conn.User)
+	setString("password", &opts.Password, conn.Password)
+	setString("database", &opts.Database, conn.Database)
+	setString("format", &opts.Format, conn.Format)
+	setString("pager", &opts.Pager, conn.Pager)
+	setString("compression", &opts.Compress, conn.Compression)
+	// the port in the config file is the one of its protocol (native for config.xml), so they are taken
+	// together, only if the user set neither of them
+	if !isSetByUser(argsParser, "protocol") && !isSetByUser(argsParser, "port") {
+		if len(conn.Protocol) > 0 {
+			opts.Protocol = conn.Protocol
+		}
+		if conn.Port != 0 {
+			opts.Port = conn.Port
+			portSet = true
+		}
+	}
+	for k, v := range conn.Settings {
+		querySettings[k] = fmt.Sprint(v)
+	}
+	return
+}
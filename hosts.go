@@ -0,0 +1,149 @@
+package main
+
+// Several replicas can be passed in --host (ch1,ch2:8124,ch3) or as hosts list in the config file. chc connects
+// to the first available one (--host-order in_order) or to a random one (--host-order random), and when the
+// connection is lost it switches to another replica. session_id exists only on the server where the session
+// was started, so with --pin-replica chc waits for the same replica instead.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	hostOrderInOrder = "in_order"
+	hostOrderRandom  = "random"
+)
+
+type replica struct {
+	Host string
+	Port uint
+}
+
+func (r replica) String() string {
+	return net.JoinHostPort(r.Host, strconv.FormatUint(uint64(r.Port), 10))
+}
+
+var replicas []replica
+
+// index in replicas, it's changed on reconnect while the background requests (autocomplete etc.) can read it
+var currentReplica int32
+
+// the replica should be taken once per request, so all its parts go to the same server
+func activeReplica() replica {
+	return replicas[atomic.LoadInt32(&currentReplica)]
+}
+
+// hosts are separated by commas, the port is optional (IPv6 addresses with the port should be in brackets)
+func parseHosts(hosts string, defaultPort uint) ([]replica, error) {
+	var result []replica
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if len(host) == 0 {
+			continue
+		}
+		r := replica{Host: host, Port: defaultPort}
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			port, err := strconv.ParseUint(p, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("Bad port in host %s", host)
+			}
+			r = replica{Host: h, Port: uint(port)}
+		} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			r.Host = host[1 : len(host)-1]
+		}
+		result = append(result, r)
+	}
+	if len(result) == 0 {
+		return nil, errors.New("Host is not set")
+	}
+	return result, nil
+}
+
+func replicaList() string {
+	names := make([]string, len(replicas))
+	for idx, r := range replicas {
+		names[idx] = r.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// connections to the previous replica are not reused
+func switchReplica(idx int) {
+	if int32(idx) == atomic.LoadInt32(&currentReplica) {
+		return
+	}
+	atomic.StoreInt32(&currentReplica, int32(idx))
+	dropNativeSession()
+	httpClient.CloseIdleConnections()
+	if headersProgressConn != nil {
+		headersProgressConn.Close()
+		headersProgressConn = nil
+	}
+}
+
+// replicas in the order they should be tried
+func replicaCandidates() []int {
+	if opts.HostOrder == hostOrderRandom {
+		return rand.Perm(len(replicas))
+	}
+	candidates := make([]int, len(replicas))
+	for idx := range candidates {
+		candidates[idx] = idx
+	}
+	return candidates
+}
+
+// tries the replicas till the first one which answers, other errors (like wrong password) are returned at once
+func connectToReplica() (version string, err error) {
+	for _, idx := range replicaCandidates() {
+		switchReplica(idx)
+		version, err = getServerVersion()
+		if err == nil || !isConnectionError(err) {
+			return
+		}
+	}
+	return
+}
+
+// waits till the server is available again, gives up after reconnectTimeout or on Ctrl+C
+func reconnect(cx context.Context) bool {
+	dropNativeSession()
+	httpClient.CloseIdleConnections()
+	if headersProgressConn != nil {
+		headersProgressConn.Close()
+		headersProgressConn = nil
+	}
+
+	previous := atomic.LoadInt32(&currentReplica)
+	deadline := time.Now().Add(reconnectTimeout)
+	for {
+		var err error
+		if opts.PinReplica {
+			_, err = getServerVersion()
+		} else {
+			_, err = connectToReplica()
+		}
+		if err == nil {
+			if atomic.LoadInt32(&currentReplica) != previous {
+				chcOutput.printServiceMsg(fmt.Sprintf("Switched to replica %s, the session (temporary tables etc.) was not kept.\n", activeReplica()))
+			}
+			return true
+		}
+		if !isConnectionError(err) || time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-cx.Done():
+			return false
+		case <-time.After(time.Second):
+		}
+	}
+}
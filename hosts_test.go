@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHosts(t *testing.T) {
+	tests := []struct {
+		hosts string
+		want  []replica
+		err   bool
+	}{
+		{hosts: "localhost", want: []replica{{"localhost", 9000}}},
+		{hosts: "ch1, ch2:8124,,ch3", want: []replica{{"ch1", 9000}, {"ch2", 8124}, {"ch3", 9000}}},
+		{hosts: "[::1]:9440", want: []replica{{"::1", 9440}}},
+		{hosts: "::1", want: []replica{{"::1", 9000}}},
+		{hosts: "[::1]", want: []replica{{"::1", 9000}}},
+		{hosts: "ch1:port", err: true},
+		{hosts: "ch1:65536", err: true},
+		{hosts: " , ", err: true},
+	}
+	for _, test := range tests {
+		got, err := parseHosts(test.hosts, 9000)
+		if !reflect.DeepEqual(got, test.want) || (err != nil) != test.err {
+			t.Errorf("parseHosts(%q) = %v, %v, want %v", test.hosts, got, err, test.want)
+		}
+	}
+
+	if got := (replica{"::1", 9000}).String(); got != "[::1]:9000" {
+		t.Errorf("replica address = %q, want [::1]:9000", got)
+	}
+}
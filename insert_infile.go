@@ -0,0 +1,272 @@
+package main
+
+// INSERT INTO t FROM INFILE 'file' [COMPRESSION 'gzip'] [FORMAT CSV] is handled on the client side (like the native
+// client does): the file is sent as the body of the request. Glob patterns (data/*.csv) insert the files one by one.
+// Compressed files are sent as is with Content-Encoding, the server decompresses them. Other files are compressed
+// on the fly with --compression.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type insertFromInfile struct {
+	Query       string // INSERT query without FROM INFILE part
+	Pattern     string // file name or glob
+	Compression string // empty if it's not set explicitly
+}
+
+var insertFromInfileRegexp = regexp.MustCompile("(?is)^\\s*(INSERT\\s+INTO\\s+.*?)\\s+FROM\\s+INFILE\\s+('(?:[^'\\\\]|\\\\.)*')(?:\\s+COMPRESSION\\s+('(?:[^'\\\\]|\\\\.)*'))?(.*)$")
+
+// returns nil if the query is not INSERT FROM INFILE
+func parseInsertFromInfile(query string) *insertFromInfile {
+	matches := insertFromInfileRegexp.FindStringSubmatch(query)
+	if matches == nil {
+		return nil
+	}
+	infile := &insertFromInfile{
+		Query:       strings.TrimSpace(matches[1] + " " + strings.TrimSpace(matches[4])),
+		Pattern:     unquoteString(matches[2]),
+		Compression: strings.ToLower(unquoteString(matches[3])),
+	}
+	if infile.Compression == "auto" {
+		infile.Compression = ""
+	}
+	return infile
+}
+
+// values of Content-Encoding understood by ClickHouse
+var contentEncodings = map[string]string{
+	"gzip":    "gzip",
+	"gz":      "gzip",
+	"deflate": "deflate",
+	"br":      "br",
+	"brotli":  "br",
+	"xz":      "xz",
+	"zstd":    "zstd",
+	"zst":     "zstd",
+	"lz4":     "lz4",
+	"bz2":     "bz2",
+	"snappy":  "snappy",
+}
+
+var formatsByExtension = map[string]string{
+	"csv":     "CSV",
+	"tsv":     formatTabSeparated,
+	"json":    "JSONEachRow",
+	"jsonl":   "JSONEachRow",
+	"ndjson":  "JSONEachRow",
+	"parquet": "Parquet",
+	"orc":     "ORC",
+	"arrow":   "Arrow",
+	"avro":    "Avro",
+	"native":  "Native",
+}
+
+func fileExtension(fileName string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(fileName), "."))
+}
+
+// compression set in the query or guessed by the extension, empty for uncompressed file
+func (infile *insertFromInfile) contentEncoding(fileName string) (string, error) {
+	switch infile.Compression {
+	case "":
+		return contentEncodings[fileExtension(fileName)], nil
+	case "none":
+		return "", nil
+	}
+	if encoding, ok := contentEncodings[infile.Compression]; ok {
+		return encoding, nil
+	}
+	return "", fmt.Errorf("Unknown compression method: %s", infile.Compression)
+}
+
+// FORMAT name outside of the brackets and literals (like SETTINGS format_csv_delimiter = 'FORMAT')
+func hasFormatClause(query string) bool {
+	var words []sqlToken
+	depth := 0
+	for _, token := range tokenizeSQL(query) {
+		switch token.Kind {
+		case tokenOpeningBracket:
+			depth++
+		case tokenClosingBracket:
+			depth--
+		case tokenWhitespace, tokenComment:
+			continue
+		}
+		words = append(words, token)
+		if last := len(words) - 1; depth == 0 && last > 0 && token.Kind == tokenBareWord &&
+			words[last-1].Kind == tokenBareWord && strings.EqualFold(words[last-1].Text, "FORMAT") {
+			return true
+		}
+	}
+	return false
+}
+
+// FORMAT is guessed by the extension (data.csv.gz is CSV) if it's not in the query
+func (infile *insertFromInfile) queryForFile(fileName string) (string, error) {
+	if hasFormatClause(infile.Query) {
+		return infile.Query, nil
+	}
+	if _, compressed := contentEncodings[fileExtension(fileName)]; compressed {
+		fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	}
+	if format, ok := formatsByExtension[fileExtension(fileName)]; ok {
+		return infile.Query + " FORMAT " + format, nil
+	}
+	return "", fmt.Errorf("FORMAT is not set and can't be guessed by the file name: %s", fileName)
+}
+
+func (infile *insertFromInfile) files() ([]string, error) {
+	files, err := filepath.Glob(infile.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No files found: %s", infile.Pattern)
+	}
+	return files, nil
+}
+
+// counts the bytes sent to the server for the upload progress
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	atomic.AddInt64(cr.count, int64(n))
+	return n, err
+}
+
+var errInfileNativeProtocol = errors.New("INSERT FROM INFILE is supported only via http")
+
+func makeInsertFromInfile(cx context.Context, infile *insertFromInfile, queryID string) queryExecutionChan {
+	queryExecutionChannel := make(chan queryExecution, 2048)
+
+	go func() {
+		start := time.Now()
+		send := func(qe queryExecution) {
+			sendPacket(cx, queryExecutionChannel, qe)
+		}
+
+		files, err := infile.files()
+		if err != nil {
+			send(queryExecution{PacketType: errPacket, Err: err})
+			return
+		}
+		var totalSize int64
+		for _, fileName := range files {
+			fi, err := os.Stat(fileName)
+			if err != nil {
+				send(queryExecution{PacketType: errPacket, Err: err})
+				return
+			}
+			totalSize += fi.Size()
+		}
+
+		var uploaded int64
+		stopProgress := func() {}
+		if opts.Progress {
+			finished, stopped := make(chan bool), make(chan bool)
+			stopProgress = func() {
+				close(finished)
+				<-stopped
+			}
+			go func() {
+				defer close(stopped)
+				ticker := time.NewTicker(time.Millisecond * 125)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						pi := progressInfo{Elapsed: time.Since(start).Seconds(), UploadedBytes: uint64(atomic.LoadInt64(&uploaded)), UploadTotalBytes: uint64(totalSize)}
+						send(queryExecution{PacketType: progressPacket, Progress: pi})
+					case <-finished:
+						return
+					}
+				}
+			}()
+		}
+
+		// the files are inserted one by one till the first failure, each one is a separate query with its own id
+		// (the first one keeps the id of the whole INSERT, so it can be found in query_log)
+		var stats queryStats
+		for idx, fileName := range files {
+			fileQueryID := queryID
+			if idx > 0 {
+				fileQueryID = get_id()
+			}
+			var query string
+			if query, err = infile.queryForFile(fileName); err != nil {
+				break
+			}
+			var response *http.Response
+			response, err = uploadInfile(cx, infile, query, fileName, fileQueryID, &uploaded)
+			if err != nil {
+				break
+			}
+			send(queryExecution{PacketType: statusPacket, StatusCode: response.StatusCode})
+			var fileStats queryStats
+			fileStats, err = streamQueryResponse(cx, response, query, formatTabSeparated, queryExecutionChannel)
+			mergeSummaryHeader(&fileStats, response.Header)
+			response.Body.Close()
+			stats.WrittenRows += fileStats.WrittenRows
+			stats.WrittenBytes += fileStats.WrittenBytes
+			stats.ServerStats = stats.ServerStats || fileStats.ServerStats
+			if err != nil || response.StatusCode != 200 {
+				break
+			}
+		}
+		stopProgress()
+
+		if err != nil {
+			send(queryExecution{PacketType: errPacket, Err: err})
+			return
+		}
+		stats.QueryDuration = time.Since(start)
+		send(queryExecution{PacketType: donePacket, Stats: stats})
+	}()
+	return queryExecutionChannel
+}
+
+func uploadInfile(cx context.Context, infile *insertFromInfile, query, fileName, queryID string, uploaded *int64) (*http.Response, error) {
+	encoding, err := infile.contentEncoding(fileName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	extraSettings := queryRequestSettings(queryID)
+	extraSettings["query"] = query
+	req, err := prepareRequestReader(countingReader{reader: f, count: uploaded}, formatTabSeparated, extraSettings)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = fi.Size()
+	switch {
+	case len(encoding) > 0:
+		req.Header.Set("Content-Encoding", encoding)
+	case len(opts.Compress) > 0:
+		setRequestCompression(req, countingReader{reader: f, count: uploaded}, opts.Compress)
+	}
+	return httpClient.Do(req.WithContext(cx))
+}
@@ -0,0 +1,90 @@
+package main
+
+import "testing"
+
+func TestParseInsertFromInfile(t *testing.T) {
+	tests := []struct {
+		query string
+		want  *insertFromInfile
+	}{
+		{"INSERT INTO t FROM INFILE 'data.csv'", &insertFromInfile{Query: "INSERT INTO t", Pattern: "data.csv"}},
+		{
+			"insert into t (a, b)\nfrom infile 'data/*.csv.gz' compression 'GZIP' format CSV;",
+			&insertFromInfile{Query: "insert into t (a, b) format CSV;", Pattern: "data/*.csv.gz", Compression: "gzip"},
+		},
+		{"INSERT INTO t FROM INFILE 'it\\'s.tsv' COMPRESSION 'auto'", &insertFromInfile{Query: "INSERT INTO t", Pattern: "it's.tsv"}},
+		{"INSERT INTO t VALUES (1)", nil},
+		{"SELECT * FROM infile", nil},
+	}
+	for _, test := range tests {
+		got := parseInsertFromInfile(test.query)
+		if (got == nil) != (test.want == nil) || (got != nil && *got != *test.want) {
+			t.Errorf("parseInsertFromInfile(%q) = %+v, want %+v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestHasFormatClause(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"INSERT INTO t FORMAT CSV", true},
+		{"INSERT INTO t format\n/* comment */ JSONEachRow", true},
+		{"INSERT INTO t", false},
+		{"INSERT INTO t (format) SETTINGS format_csv_delimiter = 'FORMAT CSV'", false},
+		{"INSERT INTO t SELECT * FROM (SELECT 1 FORMAT CSV)", false},
+		{"INSERT INTO t SETTINGS input_format_defaults_for_omitted_fields = 1 FORMAT TSV", true},
+	}
+	for _, test := range tests {
+		if got := hasFormatClause(test.query); got != test.want {
+			t.Errorf("hasFormatClause(%q) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestInfileQueryForFile(t *testing.T) {
+	tests := []struct {
+		query    string
+		fileName string
+		want     string
+		err      bool
+	}{
+		{"INSERT INTO t", "data.csv", "INSERT INTO t FORMAT CSV", false},
+		{"INSERT INTO t", "dir/data.TSV", "INSERT INTO t FORMAT " + formatTabSeparated, false},
+		{"INSERT INTO t", "data.ndjson.zst", "INSERT INTO t FORMAT JSONEachRow", false},
+		{"INSERT INTO t FORMAT Parquet", "data.csv", "INSERT INTO t FORMAT Parquet", false},
+		{"INSERT INTO t", "data.gz", "", true},
+		{"INSERT INTO t", "data.txt", "", true},
+	}
+	for _, test := range tests {
+		infile := &insertFromInfile{Query: test.query}
+		got, err := infile.queryForFile(test.fileName)
+		if got != test.want || (err != nil) != test.err {
+			t.Errorf("queryForFile(%q, %q) = %q, %v, want %q", test.query, test.fileName, got, err, test.want)
+		}
+	}
+}
+
+func TestInfileContentEncoding(t *testing.T) {
+	tests := []struct {
+		compression string
+		fileName    string
+		want        string
+		err         bool
+	}{
+		{"", "data.csv", "", false},
+		{"", "data.csv.gz", "gzip", false},
+		{"", "data.json.ZST", "zstd", false},
+		{"none", "data.csv.gz", "", false},
+		{"brotli", "data.csv", "br", false},
+		{"rar", "data.csv", "", true},
+	}
+	for _, test := range tests {
+		infile := &insertFromInfile{Compression: test.compression}
+		got, err := infile.contentEncoding(test.fileName)
+		if got != test.want || (err != nil) != test.err {
+			t.Errorf("contentEncoding(%q, %q) = %q, %v, want %q", test.compression, test.fileName, got, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+// Built-in full-screen viewer for query results (pager internal). It doesn't need external programs,
+// so it works on Windows too (raw mode and VT sequences are supported by Windows 10 console).
+//
+// Keys: arrows / hjkl - scroll, PgUp / PgDn / Space / b - page, Home / End / g / G - first / last line,
+// 0 / $ - line start / end, / - search, n / N - next / previous match, Enter - row as list of values,
+// q / Esc / Ctrl-C - quit
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/mattn/go-runewidth"
+	"golang.org/x/term"
+)
+
+const (
+	enterAlternateScreen = "\033[?1049h"
+	leaveAlternateScreen = "\033[?1049l"
+	hideCursor           = "\033[?25l"
+	showCursor           = "\033[?25h"
+	cursorHome           = "\033[H"
+	reverseVideo         = "\033[7m"
+)
+
+const horizontalScrollStep = 8
+
+// colors of server-side formats would break the width calculations
+var ansiEscapeRegexp = regexp.MustCompile("\033\\[[0-9;?]*[A-Za-z]")
+
+// collects the output of the query. Up to limit lines are kept, then the viewer is started (onOverflow)
+// and the rest of the result is streamed into it
+type pagerBuffer struct {
+	mutex       sync.Mutex
+	lines       []string
+	partial     string
+	limit       int
+	onOverflow  func() bool // returns false if the viewer can't be started
+	viewing     bool
+	passthrough io.Writer // the viewer failed to start, so the output goes there
+	finished    bool
+}
+
+func (pb *pagerBuffer) Write(p []byte) (int, error) {
+	if pb.passthrough != nil {
+		return pb.passthrough.Write(p)
+	}
+	pb.mutex.Lock()
+	text := pb.partial + string(p)
+	parts := strings.Split(text, "\n")
+	pb.partial = parts[len(parts)-1]
+	for _, line := range parts[:len(parts)-1] {
+		pb.lines = append(pb.lines, ansiEscapeRegexp.ReplaceAllString(line, ""))
+	}
+	overflow := !pb.viewing && len(pb.lines) > pb.limit
+	pb.viewing = pb.viewing || overflow
+	pb.mutex.Unlock()
+
+	if overflow && !pb.onOverflow() {
+		pb.passthrough = chcOutput.colorableStdOut
+		for _, line := range pb.lines {
+			io.WriteString(pb.passthrough, line+"\n")
+		}
+		io.WriteString(pb.passthrough, pb.partial)
+		pb.lines, pb.partial = nil, ""
+	}
+	return len(p), nil
+}
+
+// lines are only appended, so the returned slice is not changed by the following writes
+func (pb *pagerBuffer) snapshot() (lines []string, finished bool) {
+	pb.mutex.Lock()
+	defer pb.mutex.Unlock()
+	return pb.lines[:len(pb.lines):len(pb.lines)], pb.finished
+}
+
+func (pb *pagerBuffer) finish() {
+	pb.mutex.Lock()
+	defer pb.mutex.Unlock()
+	if len(pb.partial) > 0 {
+		pb.lines = append(pb.lines, ansiEscapeRegexp.ReplaceAllString(pb.partial, ""))
+		pb.partial = ""
+	}
+	pb.finished = true
+}
+
+func (pb *pagerBuffer) allLines() []string {
+	pb.finish()
+	lines, _ := pb.snapshot()
+	return lines
+}
+
+func canUseInternalPager() bool {
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+func screenSize() (width, height int) {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return 80, 24
+	}
+	return
+}
+
+// number of lines of Pretty table header, which stay on the screen while scrolling
+func prettyHeaderLines(lines []string) int {
+	if len(lines) == 0 {
+		return 0
+	}
+	switch {
+	case strings.HasPrefix(lines[0], "┏"):
+		return 3
+	case strings.HasPrefix(lines[0], "┌"):
+		return 1
+	}
+	return 0
+}
+
+// column names and cells of the line for the row view
+func prettyHeaderNames(header []string) []string {
+	switch len(header) {
+	case 1:
+		return splitTableLine(strings.Trim(header[0], "┌┐"), "┬", "─ ")
+	case 3:
+		return splitTableLine(header[1], "┃", " ")
+	}
+	return nil
+}
+
+func splitTableLine(line, separator, cutset string) []string {
+	parts := strings.Split(line, separator)
+	if len(parts) > 2 && strings.TrimSpace(parts[0]) == "" && strings.TrimSpace(parts[len(parts)-1]) == "" {
+		parts = parts[1 : len(parts)-1]
+	}
+	for idx, part := range parts {
+		parts[idx] = strings.Trim(part, cutset)
+	}
+	return parts
+}
+
+func lineCells(line string) []string {
+	switch {
+	case strings.Contains(line, "│"):
+		return splitTableLine(line, "│", " ")
+	case strings.Contains(line, "\t"):
+		return strings.Split(line, "\t")
+	}
+	return []string{line}
+}
+
+// part of the line between display columns from and from+width
+func sliceByWidth(line string, from, width int) string {
+	var sb strings.Builder
+	pos := 0
+	for _, r := range strings.Replace(line, "\t", " ", -1) {
+		w := runewidth.RuneWidth(r)
+		if pos >= from && pos+w <= from+width {
+			sb.WriteRune(r)
+		}
+		pos += w
+		if pos >= from+width {
+			break
+		}
+	}
+	return sb.String()
+}
+
+type pagerView struct {
+	source      *pagerBuffer // nil if all the lines are known
+	headerLines int
+	measured    int // lines counted in maxWidth
+	running     bool
+
+	lines     []string
+	header    []string
+	top       int // first data line on the screen
+	cursor    int // selected data line
+	left      int // horizontal offset
+	maxWidth  int
+	search    string
+	statusMsg string
+	out       io.Writer
+	in        io.Reader
+}
+
+func newPagerView(lines []string, headerLines int) *pagerView {
+	v := &pagerView{header: lines[:headerLines], lines: lines[headerLines:], out: chcOutput.colorableStdOut, in: os.Stdin}
+	for _, line := range lines {
+		if w := runewidth.StringWidth(line); w > v.maxWidth {
+			v.maxWidth = w
+		}
+	}
+	return v
+}
+
+// the lines are taken from the buffer, which is still filled by the query
+func newStreamingPagerView(source *pagerBuffer) *pagerView {
+	v := &pagerView{source: source, out: chcOutput.colorableStdOut, in: os.Stdin}
+	v.refresh()
+	return v
+}
+
+// new lines of the result are shown on the next key press
+func (v *pagerView) refresh() {
+	if v.source == nil {
+		return
+	}
+	all, finished := v.source.snapshot()
+	v.running = !finished
+	if v.headerLines == 0 {
+		v.headerLines = prettyHeaderLines(all)
+	}
+	headerLines := v.headerLines
+	if headerLines > len(all) {
+		headerLines = len(all)
+	}
+	v.header, v.lines = all[:headerLines], all[headerLines:]
+	for _, line := range all[v.measured:] {
+		if w := runewidth.StringWidth(line); w > v.maxWidth {
+			v.maxWidth = w
+		}
+	}
+	v.measured = len(all)
+}
+
+// switches the terminal to the viewer, returns false if it can't be used
+func startPagerView() (stop func(), ok bool) {
+	if !canUseInternalPager() {
+		return nil, false
+	}
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, false
+	}
+	out := chcOutput.colorableStdOut
+	io.WriteString(out, enterAlternateScreen+hideCursor)
+	return func() {
+		io.WriteString(out, showCursor+leaveAlternateScreen)
+		term.Restore(int(os.Stdin.Fd()), oldState)
+	}, true
+}
+
+func (v *pagerView) pageHeight() int {
+	_, height := screenSize()
+	if h := height - len(v.header) - 1; h > 1 {
+		return h
+	}
+	return 1
+}
+
+func (v *pagerView) draw() {
+	width, _ := screenSize()
+	height := v.pageHeight()
+	if v.cursor < v.top {
+		v.top = v.cursor
+	}
+	if v.cursor >= v.top+height {
+		v.top = v.cursor - height + 1
+	}
+
+	var sb strings.Builder
+	sb.WriteString(cursorHome)
+	writeLine := func(line string, selected bool) {
+		visible := sliceByWidth(line, v.left, width)
+		if selected {
+			visible = reverseVideo + visible + colorReset
+		}
+		sb.WriteString(visible + clearToEndOfLine + "\r\n")
+	}
+	for _, line := range v.header {
+		writeLine(line, false)
+	}
+	for idx := v.top; idx < v.top+height; idx++ {
+		if idx < len(v.lines) {
+			writeLine(v.lines[idx], idx == v.cursor)
+		} else {
+			sb.WriteString("~" + clearToEndOfLine + "\r\n")
+		}
+	}
+
+	status := v.statusMsg
+	if len(status) == 0 {
+		status = "line " + strconv.Itoa(v.cursor+1) + " of " + strconv.Itoa(len(v.lines)) + ", column " + strconv.Itoa(v.left+1) +
+			"  (q quit, / search, Enter row view)"
+		if v.running {
+			status = "loading... " + status
+		}
+	}
+	sb.WriteString(reverseVideo + sliceByWidth(status, 0, width-1) + colorReset + clearToEndOfLine)
+	io.WriteString(v.out, sb.String())
+	v.statusMsg = ""
+}
+
+func (v *pagerView) readKey() string {
+	buf := make([]byte, 16)
+	n, err := v.in.Read(buf)
+	if err != nil {
+		return "q"
+	}
+	return string(buf[:n])
+}
+
+func (v *pagerView) moveCursor(delta int) {
+	v.cursor += delta
+	if v.cursor >= len(v.lines) {
+		v.cursor = len(v.lines) - 1
+	}
+	if v.cursor < 0 {
+		v.cursor = 0
+	}
+}
+
+func (v *pagerView) scrollHorizontally(delta int) {
+	width, _ := screenSize()
+	v.left += delta
+	if v.left > v.maxWidth-width {
+		v.left = v.maxWidth - width
+	}
+	if v.left < 0 {
+		v.left = 0
+	}
+}
+
+func (v *pagerView) loop() {
+	for {
+		v.refresh()
+		v.draw()
+		switch key := v.readKey(); key {
+		case "q", "Q", "\033", "\x03":
+			return
+		case "\033[A", "\033OA", "k":
+			v.moveCursor(-1)
+		case "\033[B", "\033OB", "j":
+			v.moveCursor(1)
+		case "\033[D", "\033OD", "h":
+			v.scrollHorizontally(-horizontalScrollStep)
+		case "\033[C", "\033OC", "l":
+			v.scrollHorizontally(horizontalScrollStep)
+		case "\033[5~", "b":
+			v.moveCursor(-v.pageHeight())
+		case "\033[6~", " ":
+			v.moveCursor(v.pageHeight())
+		case "\033[H", "\033[1~", "\033OH", "g":
+			v.cursor = 0
+		case "\033[F", "\033[4~", "\033OF", "G":
+			v.moveCursor(len(v.lines))
+		case "0":
+			v.left = 0
+		case "$":
+			v.scrollHorizontally(v.maxWidth)
+		case "/":
+			if text, ok := v.readSearch(); ok && len(text) > 0 {
+				v.search = text
+				v.find(1)
+			}
+		case "n":
+			v.find(1)
+		case "N":
+			v.find(-1)
+		case "\r", "\n":
+			v.showRow()
+		}
+	}
+}
+
+// text is typed on the status line, Esc cancels the search
+func (v *pagerView) readSearch() (string, bool) {
+	var text []rune
+	for {
+		v.statusMsg = "/" + string(text)
+		v.draw()
+		switch key := v.readKey(); key {
+		case "\r", "\n":
+			return string(text), true
+		case "\033", "\x03":
+			return "", false
+		case "\x7f", "\b":
+			if len(text) > 0 {
+				text = text[:len(text)-1]
+			}
+		default:
+			if !strings.HasPrefix(key, "\033") {
+				text = append(text, []rune(key)...)
+			}
+		}
+	}
+}
+
+// byte offset of the case-insensitive match in s, -1 if there is no match. Lower case text can have other
+// length in bytes, so the offset is found in the original string
+func indexFold(s, substr string) int {
+	length := utf8.RuneCountInString(substr)
+	for start := range s {
+		end := start
+		for count := 0; count < length; count++ {
+			if end >= len(s) {
+				return -1
+			}
+			_, size := utf8.DecodeRuneInString(s[end:])
+			end += size
+		}
+		if strings.EqualFold(s[start:end], substr) {
+			return start
+		}
+	}
+	return -1
+}
+
+// searches the lines starting from the next one after the cursor (header too, for searching the column by name)
+// and scrolls to make the match visible
+func (v *pagerView) find(direction int) {
+	if len(v.search) == 0 || len(v.lines) == 0 {
+		return
+	}
+	showMatch := func(line string) {
+		idx := indexFold(line, v.search)
+		width, _ := screenSize()
+		column := runewidth.StringWidth(line[:idx])
+		if column < v.left || column+runewidth.StringWidth(v.search) > v.left+width {
+			v.left = 0
+			v.scrollHorizontally(column - width/2)
+		}
+	}
+
+	for step := 1; step <= len(v.lines); step++ {
+		idx := ((v.cursor+direction*step)%len(v.lines) + len(v.lines)) % len(v.lines)
+		if indexFold(v.lines[idx], v.search) >= 0 {
+			v.cursor = idx
+			showMatch(v.lines[idx])
+			return
+		}
+	}
+	for _, line := range v.header {
+		if indexFold(line, v.search) >= 0 {
+			showMatch(line)
+			return
+		}
+	}
+	v.statusMsg = "Pattern not found: " + v.search
+}
+
+// values of the selected row one per line without table borders, so they can be copied from the terminal
+func (v *pagerView) showRow() {
+	if len(v.lines) == 0 {
+		return
+	}
+	cells := lineCells(v.lines[v.cursor])
+	names := prettyHeaderNames(v.header)
+	if len(names) != len(cells) {
+		names = make([]string, len(cells))
+		for idx := range cells {
+			names[idx] = strconv.Itoa(idx + 1)
+		}
+	}
+
+	nameWidth := 0
+	for _, name := range names {
+		if w := runewidth.StringWidth(name); w > nameWidth {
+			nameWidth = w
+		}
+	}
+	rowLines := make([]string, len(cells))
+	for idx, cell := range cells {
+		rowLines[idx] = names[idx] + ": " + strings.Repeat(" ", nameWidth-runewidth.StringWidth(names[idx])) + cell
+	}
+
+	rowView := newPagerView(rowLines, 0)
+	io.WriteString(v.out, cursorHome+"\033[2J")
+	rowView.loop()
+	io.WriteString(v.out, "\033[2J")
+}
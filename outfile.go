@@ -0,0 +1,154 @@
+package main
+
+// SELECT ... INTO OUTFILE 'file' [AND STDOUT] [APPEND | TRUNCATE] [COMPRESSION 'gzip' [LEVEL n]] [FORMAT fmt]
+// is handled on the client side (like the native client does): the clause is cut from the query and the result
+// is written to the local file. Without APPEND / TRUNCATE the file must not exist.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const ( // iota is reset to 0
+	outfileCreate   = iota
+	outfileAppend   = iota
+	outfileTruncate = iota
+)
+
+type outfileOptions struct {
+	FileName    string
+	AndStdout   bool
+	Mode        int
+	Compression string // gzip, zstd, lz4 or empty for uncompressed file
+	Level       int    // 0 - default level of the method
+}
+
+var outfileCompressions = map[string]string{
+	"gzip": "gzip",
+	"gz":   "gzip",
+	"zstd": "zstd",
+	"zst":  "zstd",
+	"lz4":  "lz4",
+}
+
+var maxCompressionLevels = map[string]int{
+	"gzip": 9,
+	"zstd": 22,
+	"lz4":  9,
+}
+
+// returns the query without INTO OUTFILE clause, options are nil if there is no such clause
+func parseIntoOutfile(query string) (string, *outfileOptions, error) {
+	tokens := tokenizeSQL(query)
+	var meaningful []int
+	for idx, token := range tokens {
+		if token.Kind != tokenWhitespace && token.Kind != tokenComment {
+			meaningful = append(meaningful, idx)
+		}
+	}
+	word := func(pos int, expected string) bool {
+		return pos < len(meaningful) && tokens[meaningful[pos]].Kind == tokenBareWord && strings.EqualFold(tokens[meaningful[pos]].Text, expected)
+	}
+	kind := func(pos int, expected int) bool {
+		return pos < len(meaningful) && tokens[meaningful[pos]].Kind == expected
+	}
+
+	// INTO OUTFILE 'file' of the main query, not of the subqueries. Without the file name it's something
+	// else, like the table in INSERT INTO outfile
+	depth, start := 0, -1
+	for pos, idx := range meaningful {
+		switch tokens[idx].Kind {
+		case tokenOpeningBracket:
+			depth++
+		case tokenClosingBracket:
+			depth--
+		}
+		if depth == 0 && word(pos, "INTO") && word(pos+1, "OUTFILE") && kind(pos+2, tokenString) {
+			start = pos
+			break
+		}
+	}
+	if start < 0 {
+		return query, nil, nil
+	}
+
+	pos := start + 2
+	outfile := &outfileOptions{FileName: unquoteString(tokens[meaningful[pos]].Text)}
+	pos++
+	if word(pos, "AND") && word(pos+1, "STDOUT") {
+		outfile.AndStdout = true
+		pos += 2
+	}
+	switch {
+	case word(pos, "APPEND"):
+		outfile.Mode = outfileAppend
+		pos++
+	case word(pos, "TRUNCATE"):
+		outfile.Mode = outfileTruncate
+		pos++
+	}
+
+	compression := "auto"
+	if word(pos, "COMPRESSION") {
+		if !kind(pos+1, tokenString) {
+			return "", nil, errors.New("COMPRESSION expects the method in single quotes")
+		}
+		compression = strings.ToLower(unquoteString(tokens[meaningful[pos+1]].Text))
+		pos += 2
+		if word(pos, "LEVEL") {
+			if !kind(pos+1, tokenNumber) {
+				return "", nil, errors.New("LEVEL expects a number")
+			}
+			level, err := strconv.Atoi(tokens[meaningful[pos+1]].Text)
+			if err != nil {
+				return "", nil, fmt.Errorf("Wrong compression level: %s", tokens[meaningful[pos+1]].Text)
+			}
+			outfile.Level = level
+			pos += 2
+		}
+	}
+	switch compression {
+	case "auto":
+		outfile.Compression = outfileCompressions[fileExtension(outfile.FileName)]
+	case "none", "":
+	default:
+		method, ok := outfileCompressions[compression]
+		if !ok {
+			return "", nil, fmt.Errorf("Unsupported compression method: %s", compression)
+		}
+		outfile.Compression = method
+	}
+	if outfile.Level != 0 {
+		if len(outfile.Compression) == 0 {
+			return "", nil, errors.New("LEVEL is set, but the file is not compressed")
+		}
+		if maxLevel := maxCompressionLevels[outfile.Compression]; outfile.Level < 1 || outfile.Level > maxLevel {
+			return "", nil, fmt.Errorf("%s compression level should be from 1 to %d, got %d", outfile.Compression, maxLevel, outfile.Level)
+		}
+	}
+
+	end := len(query)
+	if pos < len(meaningful) {
+		end = tokens[meaningful[pos]].Start
+	}
+	rest := strings.TrimSpace(query[end:])
+	return strings.TrimSpace(strings.TrimSpace(query[:tokens[meaningful[start]].Start]) + " " + rest), outfile, nil
+}
+
+func (outfile *outfileOptions) openFlags() int {
+	switch outfile.Mode {
+	case outfileAppend:
+		return os.O_CREATE | os.O_APPEND | os.O_WRONLY
+	case outfileTruncate:
+		return os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	}
+	return os.O_CREATE | os.O_EXCL | os.O_WRONLY
+}
+
+func (outfile *outfileOptions) compressingWriter(w io.Writer) (io.WriteCloser, error) {
+	return newCompressingWriter(w, outfile.Compression, outfile.Level)
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestParseIntoOutfile(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string
+		outfile *outfileOptions
+		err     bool
+	}{
+		{query: "SELECT 1", want: "SELECT 1"},
+		{query: "INSERT INTO outfile VALUES (1)", want: "INSERT INTO outfile VALUES (1)"},
+		{query: "SELECT * FROM (SELECT 1 INTO OUTFILE 'x.csv')", want: "SELECT * FROM (SELECT 1 INTO OUTFILE 'x.csv')"},
+		{
+			query:   "SELECT 1 INTO OUTFILE 'out.tsv' FORMAT TSV",
+			want:    "SELECT 1 FORMAT TSV",
+			outfile: &outfileOptions{FileName: "out.tsv"},
+		},
+		{
+			query:   "SELECT 1\ninto outfile 'out.csv.gz' and stdout append FORMAT CSV;",
+			want:    "SELECT 1 FORMAT CSV;",
+			outfile: &outfileOptions{FileName: "out.csv.gz", AndStdout: true, Mode: outfileAppend, Compression: "gzip"},
+		},
+		{
+			query:   "SELECT 1 INTO OUTFILE 'out' TRUNCATE COMPRESSION 'ZST' LEVEL 19",
+			want:    "SELECT 1",
+			outfile: &outfileOptions{FileName: "out", Mode: outfileTruncate, Compression: "zstd", Level: 19},
+		},
+		{
+			query:   "SELECT 1 INTO OUTFILE 'out.gz' COMPRESSION 'none'",
+			want:    "SELECT 1",
+			outfile: &outfileOptions{FileName: "out.gz"},
+		},
+		{query: "SELECT 1 INTO OUTFILE 'out' COMPRESSION gzip", err: true},
+		{query: "SELECT 1 INTO OUTFILE 'out' COMPRESSION 'rar'", err: true},
+		{query: "SELECT 1 INTO OUTFILE 'out.gz' COMPRESSION 'gzip' LEVEL 10", err: true},
+		{query: "SELECT 1 INTO OUTFILE 'out' COMPRESSION 'none' LEVEL 1", err: true},
+		{query: "SELECT 1 INTO OUTFILE 'out.lz4' COMPRESSION 'lz4' LEVEL x", err: true},
+	}
+	for _, test := range tests {
+		got, outfile, err := parseIntoOutfile(test.query)
+		if (err != nil) != test.err {
+			t.Errorf("parseIntoOutfile(%q): unexpected error %v", test.query, err)
+			continue
+		}
+		if test.err {
+			continue
+		}
+		if got != test.want || (outfile == nil) != (test.outfile == nil) || (outfile != nil && *outfile != *test.outfile) {
+			t.Errorf("parseIntoOutfile(%q) = %q, %+v, want %q, %+v", test.query, got, outfile, test.want, test.outfile)
+		}
+	}
+}
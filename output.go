@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"strings"
@@ -15,11 +16,15 @@ import (
 // TODO: errors
 
 const ( // iota is reset to 0
-	omStd   = iota
-	omPager = iota
-	omFile  = iota
+	omStd           = iota
+	omPager         = iota
+	omFile          = iota
+	omInternalPager = iota
 )
 
+const internalPagerName = "internal"
+const autoPagerName = "auto"
+
 // do we need to make it thread-safe?
 type outputStruct struct {
 	outputMode uint
@@ -36,8 +41,15 @@ type outputStruct struct {
 	waitingPager    chan struct{}
 
 	fileHandle         *os.File
+	fileCompressor     io.WriteCloser
 	fileBufferedWriter *bufio.Writer
-	fileName           string
+	outfile            *outfileOptions
+
+	// with autoPager result which doesn't fit the screen is shown in internal pager
+	autoPager    bool
+	pagerBuffer  *pagerBuffer
+	pagerViewing chan struct{} // closed when the internal pager is closed
+	savedStdErr  io.Writer     // messages and progress are not shown over the internal pager
 }
 
 var chcOutput = newOutput()
@@ -58,44 +70,69 @@ func (output *outputStruct) printServiceMsg(str string) {
 }
 
 func (output *outputStruct) setPager(cmd string) {
+	if cmd == autoPagerName {
+		output.outputMode = omStd
+		output.autoPager = true
+		return
+	}
+	if cmd == internalPagerName {
+		output.outputMode = omInternalPager
+		return
+	}
 	output.outputMode = omPager
 	parts := strings.Split(cmd, " ")
 	output.pagerExecutable, output.pagerParams = parts[0], parts[1:]
 }
 
-func (output *outputStruct) setOutfile(filename string) {
+func (output *outputStruct) setOutfile(outfile *outfileOptions) {
 	output.prevMode = output.outputMode
-	output.fileName = filename
+	output.outfile = outfile
 	output.outputMode = omFile
 }
 
 func (output *outputStruct) resetOutfile() {
 	output.outputMode = output.prevMode
-	output.fileName = ""
+	output.outfile = nil
 }
 
 func (output *outputStruct) reset() {
 	output.outputMode = omStd
+	output.autoPager = false
 	output.StdOut = output.colorableStdOut
 	output.pagerExecutable = ""
-	output.fileName = ""
+	output.outfile = nil
 	output.pagerParams = []string{}
 }
 
 func (output *outputStruct) startOutput() {
 	switch output.outputMode {
-	case omStd:
+	case omStd, omInternalPager:
 		output.StdOut = output.colorableStdOut
+		if output.pagerBuffer != nil {
+			output.StdOut = output.pagerBuffer
+		}
 	case omPager:
 		output.StdOut = output.pagerWriter
 	case omFile:
 		output.StdOut = output.fileBufferedWriter
+		if output.outfile.AndStdout {
+			output.StdOut = io.MultiWriter(output.fileBufferedWriter, output.colorableStdOut)
+		}
 	}
 }
 
 func (output *outputStruct) setupOutput(cancel context.CancelFunc) bool {
 	switch output.outputMode {
 	case omStd:
+		// only one screen is kept, larger results are streamed to the internal pager
+		if output.autoPager && canUseInternalPager() {
+			_, height := screenSize()
+			output.pagerBuffer = output.newPagerBuffer(height-2, cancel)
+		}
+	case omInternalPager:
+		if canUseInternalPager() {
+			output.pagerBuffer = output.newPagerBuffer(0, cancel)
+		}
 	case omPager:
 		cmd := exec.Command(output.pagerExecutable, output.pagerParams...)
 		pagerWriter, err := cmd.StdinPipe()
@@ -120,21 +157,82 @@ func (output *outputStruct) setupOutput(cancel context.CancelFunc) bool {
 			cmd.Wait()
 		}()
 	case omFile:
-		filehandle, err := os.OpenFile(output.fileName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0755)
+		filehandle, err := os.OpenFile(output.outfile.FileName, output.outfile.openFlags(), 0644)
 		if err != nil {
 			output.printServiceMsg(fmt.Sprintf("Unable to %s\n", err))
 			output.resetOutfile()
 			return false
 		}
+		compressor, err := output.outfile.compressingWriter(filehandle)
+		if err != nil {
+			output.printServiceMsg(fmt.Sprintf("Unable to compress %s: %s\n", output.outfile.FileName, err))
+			filehandle.Close()
+			output.resetOutfile()
+			return false
+		}
 		output.fileHandle = filehandle
-		output.fileBufferedWriter = bufio.NewWriter(filehandle)
+		output.fileCompressor = compressor
+		output.fileBufferedWriter = bufio.NewWriter(compressor)
 	}
 	return true
 }
 
+func (output *outputStruct) newPagerBuffer(limit int, cancel context.CancelFunc) *pagerBuffer {
+	pb := &pagerBuffer{limit: limit}
+	// called from Write, so in the same goroutine as the rest of the output
+	pb.onOverflow = func() bool {
+		stop, ok := startPagerView()
+		if !ok {
+			return false
+		}
+		clearProgress(output.StdErr)
+		output.savedStdErr, output.StdErr = output.StdErr, ioutil.Discard
+		viewing := make(chan struct{})
+		output.pagerViewing = viewing
+		go func() {
+			defer close(viewing)
+			// closing the pager before the end of the result stops the query
+			defer cancel()
+			defer stop()
+			newStreamingPagerView(pb).loop()
+		}()
+		return true
+	}
+	return pb
+}
+
+// waits till the internal pager is closed, or prints the result if it fits the screen. It's called after
+// the query is finished (or failed), before the messages and the statistics are printed
+func (output *outputStruct) finishOutput() {
+	if output.pagerBuffer == nil {
+		return
+	}
+	pb := output.pagerBuffer
+	output.pagerBuffer = nil
+	output.StdOut = output.colorableStdOut
+
+	if output.pagerViewing != nil {
+		pb.finish()
+		<-output.pagerViewing
+		output.pagerViewing = nil
+		output.StdErr = output.savedStdErr
+		// progress written while the pager was shown went nowhere
+		writtenProgressChars = 0
+		return
+	}
+	if pb.passthrough != nil {
+		return
+	}
+	for _, line := range pb.allLines() {
+		io.WriteString(output.StdOut, line+"\n")
+	}
+}
+
 func (output *outputStruct) releaseOutput() {
+	output.finishOutput()
 	switch output.outputMode {
 	case omStd:
+	case omInternalPager:
 	case omPager:
 
 		// Close stdin (result in pager to exit)
@@ -144,8 +242,17 @@ func (output *outputStruct) releaseOutput() {
 		<-output.waitingPager
 
 	case omFile:
-		output.fileBufferedWriter.Flush()
-		output.fileHandle.Close()
+		err := output.fileBufferedWriter.Flush()
+		// compressed data is written on close
+		if closeErr := output.fileCompressor.Close(); err == nil {
+			err = closeErr
+		}
+		if closeErr := output.fileHandle.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			output.printServiceMsg(fmt.Sprintf("Unable to write %s: %s\n", output.outfile.FileName, err))
+		}
 		output.resetOutfile()
 	}
 }
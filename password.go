@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// AUTHENTICATION_FAILED, and older WRONG_PASSWORD / REQUIRED_PASSWORD
+var authenticationErrorCodes = map[int]bool{516: true, 193: true, 194: true}
+
+// returns 0 if error is not a ClickHouse exception
+func exceptionCode(err error) int {
+	switch e := err.(type) {
+	case *serverException:
+		return e.Code
+	case *nativeException:
+		return int(e.Code)
+	}
+	return 0
+}
+
+func isAuthenticationError(err error) bool {
+	return err != nil && authenticationErrorCodes[exceptionCode(err)]
+}
+
+// reads password with echo disabled, if stdin is redirected the terminal is opened directly
+func readPassword(prompt string) (string, error) {
+	fmt.Fprint(chcOutput.StdErr, prompt)
+	defer fmt.Fprintln(chcOutput.StdErr)
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		return string(password), err
+	}
+
+	tty, err := openTerminal()
+	if err != nil {
+		return "", errors.New("Can't ask password: no terminal available")
+	}
+	defer tty.Close()
+	password, err := term.ReadPassword(int(tty.Fd()))
+	return string(password), err
+}
+
+func askPassword() {
+	password, err := readPassword("Password for user (" + opts.User + "): ")
+	if err != nil {
+		chcOutput.printServiceMsg(err.Error() + "\n")
+		os.Exit(1)
+	}
+	opts.Password = password
+	dropNativeSession()
+}
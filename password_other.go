@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+func openTerminal() (*os.File, error) {
+	return os.Open("/dev/tty")
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// console input, it should be writable to change the console mode (disable echo)
+func openTerminal() (*os.File, error) {
+	return os.OpenFile("CONIN$", os.O_RDWR, 0)
+}
@@ -123,3 +123,31 @@ func writeProgres(w io.Writer, progressRows, progressBytes, totalRows, elapsedNa
 
 	increment++
 }
+
+// INSERT FROM INFILE: bytes sent to the server and the size of the files are known, so the bar is always shown
+func writeUploadProgress(w io.Writer, uploadedBytes, totalBytes, elapsedNanoseconds uint64) {
+	clearProgress(w)
+	speed := ". "
+	if elapsedNanoseconds != 0 {
+		speed = fmt.Sprintf(" (%s/s.) ", formatReadableSizeWithDecimalSuffix(float64(uploadedBytes)*float64(1000000000.0)/float64(elapsedNanoseconds)))
+	}
+	str := fmt.Sprintf(" Uploaded: %s of %s%s", formatReadableSizeWithDecimalSuffix(float64(uploadedBytes)), formatReadableSizeWithDecimalSuffix(float64(totalBytes)), speed)
+	writtenProgressChars = len(str) + 1
+
+	if uploadedBytes > totalBytes {
+		uploadedBytes = totalBytes
+	}
+	progressBarStr := ""
+	widthOfProgressBar := readline.GetScreenWidth() - writtenProgressChars - len(" 100%")
+	if widthOfProgressBar > 0 && totalBytes > 0 {
+		fullBarsWidth := int(math.Floor(float64(widthOfProgressBar) * float64(uploadedBytes) / float64(totalBytes)))
+		progressBarStr = "\033[0;32m" + strings.Repeat("█", fullBarsWidth) + strings.Repeat(" ", widthOfProgressBar-fullBarsWidth) + "\033[0m"
+	}
+	if totalBytes > 0 {
+		progressBarStr += fmt.Sprintf(" %3.0f%%", float64(uploadedBytes)*float64(100)/float64(totalBytes))
+	}
+
+	w.Write([]byte(saveCursorPosition + indicators[increment%8] + str + progressBarStr))
+
+	increment++
+}
@@ -0,0 +1,53 @@
+package main
+
+// readline (unlike liner) knows only Alt-B / Alt-F for word moves and has no Shift-Tab, so the keys are
+// translated before readline reads them: Ctrl-Left / Ctrl-Right become Alt-B / Alt-F, and Shift-Tab becomes
+// shiftTabKey, which the completer turns into Tab with the backward direction.
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/chzyer/readline"
+)
+
+// a rune from the private use area, it can't be typed
+const shiftTabKey = '\uE000'
+
+// replacements are never longer than the sequences, so they fit into the same buffer
+var vtKeyTranslations = strings.NewReplacer(
+	"\033[1;5D", "\033b", // Ctrl-Left
+	"\033[1;5C", "\033f", // Ctrl-Right
+	"\033[1;3D", "\033b", // Alt-Left
+	"\033[1;3C", "\033f", // Alt-Right
+	"\033Od", "\033b", // Ctrl-Left in rxvt
+	"\033Oc", "\033f", // Ctrl-Right in rxvt
+	"\033[Z", string(shiftTabKey),
+)
+
+// terminals send the escape sequence of a key in one write, so it comes in one read
+type vtKeyReader struct {
+	io.Reader
+}
+
+func (kr vtKeyReader) Read(p []byte) (int, error) {
+	n, err := kr.Reader.Read(p)
+	if n > 0 && bytes.IndexByte(p[:n], '\033') >= 0 {
+		n = copy(p, vtKeyTranslations.Replace(string(p[:n])))
+	}
+	return n, err
+}
+
+func promptStdin() io.ReadCloser {
+	return readline.NewCancelableStdin(newKeyReader())
+}
+
+// readline.Config.FuncFilterInputRune
+func (c *lineCompleter) filterKey(r rune) (rune, bool) {
+	if r == shiftTabKey {
+		c.backward = true
+		return readline.CharTab, true
+	}
+	return r, true
+}
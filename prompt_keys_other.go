@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+
+	"github.com/chzyer/readline"
+)
+
+func newKeyReader() io.Reader {
+	return vtKeyReader{readline.Stdin}
+}
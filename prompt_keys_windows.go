@@ -0,0 +1,115 @@
+//go:build windows
+
+package main
+
+// The console reader of readline loses the Ctrl and Shift state of the keys, so the console input records
+// are read here and translated to what readline expects (as its own reader does).
+
+import (
+	"io"
+	"syscall"
+	"unsafe"
+
+	"github.com/chzyer/readline"
+)
+
+var procReadConsoleInput = syscall.NewLazyDLL("kernel32.dll").NewProc("ReadConsoleInputW")
+
+const (
+	keyEvent = 0x0001
+
+	rightAltPressed  = 0x0001
+	leftAltPressed   = 0x0002
+	rightCtrlPressed = 0x0004
+	leftCtrlPressed  = 0x0008
+	shiftPressed     = 0x0010
+
+	vkTab    = 0x09
+	vkEnd    = 0x23
+	vkHome   = 0x24
+	vkLeft   = 0x25
+	vkUp     = 0x26
+	vkRight  = 0x27
+	vkDown   = 0x28
+	vkDelete = 0x2E
+)
+
+type inputRecord struct {
+	EventType uint16
+	_         uint16
+	Event     [16]byte
+}
+
+type keyEventRecord struct {
+	KeyDown         int32
+	RepeatCount     uint16
+	VirtualKeyCode  uint16
+	VirtualScanCode uint16
+	UnicodeChar     uint16
+	ControlKeyState uint32
+}
+
+type consoleKeyReader struct{}
+
+func newKeyReader() io.Reader {
+	return consoleKeyReader{}
+}
+
+// one key in one read
+func (consoleKeyReader) Read(p []byte) (int, error) {
+	for {
+		var record inputRecord
+		var read uint32
+		r1, _, err := procReadConsoleInput.Call(uintptr(syscall.Stdin), uintptr(unsafe.Pointer(&record)), 1, uintptr(unsafe.Pointer(&read)))
+		if r1 == 0 {
+			return 0, err
+		}
+		if record.EventType != keyEvent {
+			continue
+		}
+		key := (*keyEventRecord)(unsafe.Pointer(&record.Event[0]))
+		if key.KeyDown == 0 {
+			continue
+		}
+		ctrl := key.ControlKeyState&(leftCtrlPressed|rightCtrlPressed) != 0
+		alt := key.ControlKeyState&(leftAltPressed|rightAltPressed) != 0
+
+		var seq string
+		switch key.VirtualKeyCode {
+		case vkLeft:
+			seq = string(rune(readline.CharBackward))
+			if ctrl || alt {
+				seq = "\033b"
+			}
+		case vkRight:
+			seq = string(rune(readline.CharForward))
+			if ctrl || alt {
+				seq = "\033f"
+			}
+		case vkUp:
+			seq = string(rune(readline.CharPrev))
+		case vkDown:
+			seq = string(rune(readline.CharNext))
+		case vkHome:
+			seq = string(rune(readline.CharLineStart))
+		case vkEnd:
+			seq = string(rune(readline.CharLineEnd))
+		case vkDelete:
+			seq = string(rune(readline.CharDelete))
+		case vkTab:
+			seq = string(rune(readline.CharTab))
+			if key.ControlKeyState&shiftPressed != 0 {
+				seq = string(shiftTabKey)
+			}
+		default:
+			if key.UnicodeChar == 0 {
+				continue // Ctrl, Shift etc. alone
+			}
+			seq = string(rune(key.UnicodeChar))
+			if alt && !ctrl { // AltGr is reported as Ctrl+Alt
+				seq = "\033" + seq
+			}
+		}
+		return copy(p, seq), nil
+	}
+}
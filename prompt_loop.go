@@ -6,7 +6,7 @@ import (
 	"regexp"
 	"strings"
 
-	"github.com/filimonov/liner" // there is also github.com/chzyer/readline and https://github.com/Bowery/prompt
+	"github.com/chzyer/readline" // unlike github.com/filimonov/liner it can repaint the line (Painter) for highlighting, there is also https://github.com/Bowery/prompt
 )
 
 var prompt = ":) "
@@ -14,23 +14,35 @@ var promptNextLines = ":-] "
 var historyFn = filepath.Join(homedir(), ".clickhouse_history")
 
 func promptLoop() {
-	linerCtrl := liner.NewLiner()
-	defer linerCtrl.Close()
-
-	initAutocomlete()
-
-	linerCtrl.SetMultiLineMode(true)
-	linerCtrl.SetCtrlCAborts(true)
-	linerCtrl.SetCompleter(clickhouseComleter)
-
-	readHistoryFromFile(linerCtrl, historyFn)
+	initAutocomleteInBackground()
+
+	completer := &lineCompleter{}
+	highlighter := &sqlHighlighter{}
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:                 prompt,
+		HistoryFile:            historyFn,
+		DisableAutoSaveHistory: true,
+		HistorySearchFold:      true,
+		AutoComplete:           completer,
+		Listener:               completer,
+		Painter:                highlighter,
+		Stdin:                  promptStdin(),
+		FuncFilterInputRune:    completer.filterKey,
+	})
+	if err != nil {
+		chcOutput.printServiceMsg(err.Error() + "\n")
+		os.Exit(1)
+	}
+	defer rl.Close()
+	completer.menu = rl
 
 	var cmds []string
 
-	currentPrompt := prompt
 promptLoop:
 	for {
-		line, err := linerCtrl.Prompt(currentPrompt)
+		highlighter.previousLines = joinPreviousLines(cmds)
+		completer.previousLines = highlighter.previousLines
+		line, err := rl.Readline()
 		if err != nil {
 			break
 		}
@@ -43,13 +55,17 @@ promptLoop:
 			cmds = append(cmds, line)
 			sql := strings.Join(cmds, " ")
 			cmds = cmds[:0]
-			currentPrompt = prompt
-			writeUpdatedHistory(linerCtrl, historyFn, sql)
+			rl.SetPrompt(prompt)
+			rl.SaveHistory(sql)
+			countCompletionUsage(sql)
 		case resSkipAndContinue:
 			continue promptLoop
 		case resContinuePrompting:
+			if !opts.Multiline {
+				line = strings.TrimSuffix(line, "\\")
+			}
 			cmds = append(cmds, line)
-			currentPrompt = promptNextLines
+			rl.SetPrompt(promptNextLines)
 			continue promptLoop
 		case resBreak:
 			break promptLoop
@@ -69,9 +85,11 @@ var exitRegexp = regexp.MustCompile("(?i)(?:^\\s*(?:exit|quit|logout)\\s*;?|^\\s
 var helpRegexp = regexp.MustCompile("(?:(?i)^\\s*help|\\\\[\\?h]|^\\s*\\?)\\s*$")
 var pagerRegexp = regexp.MustCompile("(?i)^\\s*pager\\s+(.+)\\s*$")
 var nopagerRegexp = regexp.MustCompile("(?i)^\\s*nopager\\s*$")
+var setRegexp = regexp.MustCompile("^\\s*\\\\set\\s*$")
+var expandedRegexp = regexp.MustCompile("^\\s*\\\\x(?:\\s+(\\w+))?\\s*$")
+var unsetRegexp = regexp.MustCompile("^\\s*\\\\unset\\s+(\\w+)\\s*;?\\s*$")
 
 var formatRegexp = regexp.MustCompile("(?i)FORMAT\\s+(\\w+|\"\\w+\"|`\\w+`)\\s*$")
-var intoOutfileRegexp = regexp.MustCompile("(?i)INTO\\s+OUTFILE\\s+'([^']+)'\\s*$")
 
 func executeOrContinue(prevLines []string, line string) int {
 
@@ -101,9 +119,24 @@ func executeOrContinue(prevLines []string, line string) int {
 		chcOutput.reset()
 		return resExecuted
 
+	case setRegexp.MatchString(line) && len(prevLines) == 0:
+		printSettings()
+		return resExecuted
+
+	case expandedRegexp.MatchString(line) && len(prevLines) == 0:
+		setExpandedMode(expandedRegexp.FindStringSubmatch(line)[1])
+		return resExecuted
+
+	case unsetRegexp.MatchString(line) && len(prevLines) == 0:
+		unsetSetting(unsetRegexp.FindStringSubmatch(line)[1])
+		return resExecuted
+
 	case strings.HasSuffix(line, "\\#"):
-		initAutocomlete()
-		chcOutput.printServiceMsg("autocomplete keywords reloaded\n")
+		if err := initAutocomlete(); err != nil {
+			chcOutput.printServiceMsg("Can't reload autocomplete keywords: " + err.Error() + "\n")
+		} else {
+			chcOutput.printServiceMsg("autocomplete keywords reloaded\n")
+		}
 		return resExecuted
 
 	case strings.HasSuffix(line, "\\c"):
@@ -141,29 +174,39 @@ func executeOrContinue(prevLines []string, line string) int {
 	case strings.HasSuffix(line, "\\p"):
 		sqlToExequte = "SELECT query_id, user, address, elapsed, read_rows, memory_usage FROM system.processes"
 
-	default:
+	// in single-line mode Enter executes the query, unless the line ends with backslash
+	case opts.Multiline || strings.HasSuffix(line, "\\"):
 		return resContinuePrompting
 	}
 
-	sqlToExequte, format = parseFormatAndOutfile(sqlToExequte, format)
+	sqlToExequte, format, err := parseFormatAndOutfile(sqlToExequte, format)
+	if err != nil {
+		chcOutput.printServiceMsg(err.Error() + "\n")
+		return resExecuted
+	}
 	fireQuery(sqlToExequte, format, true)
 	return resExecuted
 }
 
-func parseFormatAndOutfile(sqlToExequte, format string) (string, string) {
+func parseFormatAndOutfile(sqlToExequte, format string) (string, string, error) {
+	// FORMAT can be after INTO OUTFILE clause, so the clause is cut first
+	sqlToExequte, outfile, err := parseIntoOutfile(sqlToExequte)
+	if err != nil {
+		return "", "", err
+	}
+
 	formatMatch := formatRegexp.FindStringSubmatch(sqlToExequte)
 
-	if formatMatch != nil {
+	// FORMAT of INSERT FROM INFILE is the format of the file, it should stay in the query
+	if formatMatch != nil && parseInsertFromInfile(sqlToExequte) == nil {
 		format = strings.Trim(formatMatch[1], "\"`")
 		//println("Format:" + format)
 		sqlToExequte = formatRegexp.ReplaceAllString(sqlToExequte, "")
 		//println("SQL:" + sqlToExequte)
 	}
 
-	intoOutfileMatch := intoOutfileRegexp.FindStringSubmatch(sqlToExequte)
-	if intoOutfileMatch != nil {
-		chcOutput.setOutfile(strings.Trim(intoOutfileMatch[1], "'"))
-		sqlToExequte = intoOutfileRegexp.ReplaceAllString(sqlToExequte, "")
+	if outfile != nil {
+		chcOutput.setOutfile(outfile)
 
 		// for INTO OUTFILE default format is TabSeparated
 		if len(format) == 0 {
@@ -174,32 +217,50 @@ func parseFormatAndOutfile(sqlToExequte, format string) (string, string) {
 
 	if len(format) == 0 {
 		format = opts.Format
+		if expandedMode == expandedOn {
+			format = formatVertical
+		}
 	}
-	return sqlToExequte, format
-}
-
-// wrapper for ReadHistory. Returns the number of lines read, and any read error (except io.EOF).
-func readHistoryFromFile(s *liner.State, historyFn string) (num int, err error) {
-	f, fileErr := os.Open(historyFn)
-	if fileErr != nil {
-		err = fileErr
-		return
-	}
-	defer f.Close()
-	return s.ReadHistory(f)
+	return sqlToExequte, format, nil
 }
 
-func writeUpdatedHistory(s *liner.State, historyFn string, newHistoryLine string) (num int, err error) {
-	s.AppendHistory(newHistoryLine)
+// expanded (vertical) display mode, like \x in psql
+const ( // iota is reset to 0
+	expandedOff  = iota
+	expandedOn   = iota
+	expandedAuto = iota // vertical output only when the table doesn't fit the terminal
+)
 
-	f, fileErr := os.Create(historyFn)
+var expandedMode = expandedOff
 
-	if fileErr != nil {
-		err = fileErr
+// without argument it toggles the mode on / off
+func setExpandedMode(arg string) {
+	switch strings.ToLower(arg) {
+	case "":
+		if expandedMode == expandedOff {
+			expandedMode = expandedOn
+		} else {
+			expandedMode = expandedOff
+		}
+	case "on":
+		expandedMode = expandedOn
+	case "off":
+		expandedMode = expandedOff
+	case "auto":
+		expandedMode = expandedAuto
+	default:
+		chcOutput.printServiceMsg("\\x expects on, off or auto\n")
 		return
 	}
-	defer f.Close()
-	return s.WriteHistory(f)
+
+	switch expandedMode {
+	case expandedOn:
+		chcOutput.printServiceMsg("Expanded display is on.\n")
+	case expandedOff:
+		chcOutput.printServiceMsg("Expanded display is off.\n")
+	case expandedAuto:
+		chcOutput.printServiceMsg("Expanded display is used automatically.\n")
+	}
 }
 
 func printHelp() {
@@ -211,6 +272,7 @@ Ctrl-B, Left      Move cursor one character left
 Ctrl-F, Right     Move cursor one character right
 Ctrl-Left, Alt-B  Move cursor to previous word
 Ctrl-Right, Alt-F Move cursor to next word
+Alt-D             Delete word after cursor
 Ctrl-D, Del       Delete character under cursor (if line is not empty)
 Ctrl-D            End of File - usually quits application (if line is empty)
 Ctrl-L            Clear screen (line is unmodified)
@@ -230,7 +292,8 @@ Following commands are supported (can be changed in further versions).
 ?    - help
 help - help
 exit - exit (also understands "quit", "logout", "q")
-pager - set pager (for example "pager less -S -R")
+pager - set pager (for example "pager less -S -R"), "pager internal" for built-in viewer,
+        "pager auto" to open results higher than the screen in built-in viewer
 nopager - disable pager
 
 
@@ -245,6 +308,9 @@ Mysql/psql-alike commands
 \l - list databases
 \d - show tables
 \p - processlist
+\set - show settings changed with SET queries, config file or command line
+\unset name - reset the setting
+\x [on|off|auto] - toggle vertical output, with auto it's used when the table is wider than the terminal
 \q - quit
 `)
 
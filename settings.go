@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// query parameters for {name:Type} placeholders, passed as param_name url arguments
+var queryParameters = make(map[string]string)
+
+var settingNameRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+func setQuerySetting(setting string) bool {
+	kv := strings.SplitN(setting, "=", 2)
+	if len(kv) != 2 || !settingNameRegexp.MatchString(kv[0]) {
+		return false
+	}
+	querySettings[kv[0]] = kv[1]
+	return true
+}
+
+// names of the settings passed as unknown options, they are checked by checkSettingArgs
+var settingArgs []string
+
+// unknown options like --max_threads=8 are treated as settings, and --param_name=value as query parameters.
+// Other unknown options are errors (--max_threads 8 is not accepted, so a mistyped option doesn't take
+// the next argument as its value). Returns the arguments which are not options.
+func parseSettingArgs(args []string) (ignored []string, err error) {
+	var unknown []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			ignored = append(ignored, arg)
+			continue
+		}
+
+		kv := strings.SplitN(strings.TrimPrefix(arg, "--"), "=", 2)
+		if !strings.HasPrefix(arg, "--") || len(kv) != 2 || !settingNameRegexp.MatchString(kv[0]) {
+			unknown = append(unknown, arg)
+			continue
+		}
+
+		if strings.HasPrefix(kv[0], "param_") && len(kv[0]) > len("param_") {
+			queryParameters[kv[0][len("param_"):]] = kv[1]
+		} else {
+			querySettings[kv[0]] = kv[1]
+			settingArgs = append(settingArgs, kv[0])
+		}
+	}
+	if len(unknown) > 0 {
+		err = fmt.Errorf("Unknown options: %s", strings.Join(unknown, " "))
+	}
+	return
+}
+
+// settings passed as options should exist on the server (custom_ ones are defined by the user). If the server
+// can't be asked, the check is skipped - the query will fail the same way
+func checkSettingArgs() error {
+	if len(settingArgs) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(settingArgs))
+	for idx, name := range settingArgs {
+		quoted[idx] = quoteString(name)
+	}
+	data, err := serviceRequest("SELECT name FROM system.settings WHERE name IN (" + strings.Join(quoted, ", ") + ")")
+	if err != nil {
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, row := range data {
+		if len(row) > 0 {
+			known[row[0]] = true
+		}
+	}
+	var unknown []string
+	for _, name := range settingArgs {
+		if !known[name] && !strings.HasPrefix(name, "custom_") {
+			unknown = append(unknown, "--"+name)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("Unknown options: %s (they are neither chc options nor ClickHouse settings)", strings.Join(unknown, " "))
+	}
+	return nil
+}
+
+var literalUnescaper = strings.NewReplacer(
+	"\\\\", "\\",
+	"\\'", "'",
+	"''", "'",
+	"\\b", "\b",
+	"\\f", "\f",
+	"\\r", "\r",
+	"\\n", "\n",
+	"\\t", "\t",
+	"\\0", "\x00",
+)
+
+// parses SET name = value[, name2 = value2 ...], values can be strings, numbers (also negative and floats)
+// or bare words like true / NULL. Returns nil for other queries, including SET ROLE
+func parseSetQuery(query string) map[string]string {
+	var tokens []sqlToken
+	for _, token := range tokenizeSQL(query) {
+		if token.Kind != tokenWhitespace && token.Kind != tokenComment {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) > 0 && tokens[len(tokens)-1].Kind == tokenSemicolon {
+		tokens = tokens[:len(tokens)-1]
+	}
+	if len(tokens) < 4 || tokens[0].Kind != tokenBareWord || !strings.EqualFold(tokens[0].Text, "SET") {
+		return nil
+	}
+
+	settings := make(map[string]string)
+	pos := 1
+	for {
+		if pos+2 >= len(tokens) || tokens[pos+1].Text != "=" {
+			return nil
+		}
+
+		var name string
+		switch tokens[pos].Kind {
+		case tokenBareWord:
+			name = tokens[pos].Text
+		case tokenQuotedIdentifier:
+			name = tokens[pos].Text[1 : len(tokens[pos].Text)-1]
+		default:
+			return nil
+		}
+		pos += 2
+
+		sign := ""
+		if tokens[pos].Text == "-" || tokens[pos].Text == "+" {
+			sign = tokens[pos].Text
+			pos++
+			if pos >= len(tokens) || tokens[pos].Kind != tokenNumber {
+				return nil
+			}
+		}
+
+		value := tokens[pos]
+		switch {
+		case value.Unterminated:
+			return nil
+		case value.Kind == tokenString:
+			settings[name] = literalUnescaper.Replace(value.Text[1 : len(value.Text)-1])
+		case value.Kind == tokenNumber:
+			settings[name] = strings.TrimPrefix(sign, "+") + value.Text
+		case value.Kind == tokenBareWord:
+			settings[name] = value.Text
+		default:
+			return nil
+		}
+		pos++
+
+		if pos == len(tokens) {
+			return settings
+		}
+		if tokens[pos].Text != "," {
+			return nil
+		}
+		pos++
+	}
+}
+
+// settings from config file and command line, overridden by the ones changed with SET queries.
+// Settings are sent with each query, so they are not lost if the session expires
+func userSettings() map[string]string {
+	settings := make(map[string]string)
+	for k, v := range querySettings {
+		settings[k] = v
+	}
+	for k, v := range clickhouseSetting {
+		settings[k] = v
+	}
+	return settings
+}
+
+func printSettings() {
+	settings := userSettings()
+	if len(settings) == 0 {
+		chcOutput.printServiceMsg("No settings are changed\n")
+		return
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := settings[name]
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			value = quoteString(value)
+		}
+		chcOutput.printServiceMsg(fmt.Sprintf("%s = %s\n", name, value))
+	}
+}
+
+func unsetSetting(name string) {
+	_, inSession := clickhouseSetting[name]
+	_, inQuery := querySettings[name]
+	if !inSession && !inQuery {
+		chcOutput.printServiceMsg("Setting " + name + " is not changed\n")
+		return
+	}
+	delete(clickhouseSetting, name)
+	delete(querySettings, name)
+
+	if inSession {
+		if err := resetSessionSetting(name); err != nil {
+			chcOutput.printServiceMsg("Unable to reset setting " + name + " in the session: " + err.Error() + "\n")
+			return
+		}
+	}
+	chcOutput.printServiceMsg("Setting " + name + " is reset\n")
+}
+
+// SET query changed the setting in the server-side session too, so it is set back to the value
+// which the user has without the session
+func resetSessionSetting(name string) error {
+	// service requests are made without the session, so they see the default value
+	data, err := serviceRequest("SELECT value FROM system.settings WHERE name = " + quoteString(name))
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 || len(data[0]) == 0 {
+		return fmt.Errorf("Unknown setting %s", name)
+	}
+
+	query := fmt.Sprintf("SET %s = %s", name, quoteString(data[0][0]))
+	if opts.Protocol == protocolNative {
+		return nativeSessionExec(query)
+	}
+	sessionSettings := map[string]string{"session_id": sessionID, "session_timeout": "1800"}
+	_, err = serviceRequestWithExtraSetting(query, sessionSettings, 30)
+	return err
+}
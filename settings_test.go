@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSetQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  map[string]string
+	}{
+		{"SET max_threads = 8", map[string]string{"max_threads": "8"}},
+		{"set x = -1.5, y = 'a\\'b';", map[string]string{"x": "-1.5", "y": "a'b"}},
+		{"SET `a b` = 'it''s', c = +1e-3, d = true", map[string]string{"a b": "it's", "c": "1e-3", "d": "true"}},
+		{"SET /* comment */ x = 1 -- comment", map[string]string{"x": "1"}},
+		{"SET ROLE admin", nil},
+		{"SET DEFAULT ROLE NONE TO user", nil},
+		{"SET x = 1,", nil},
+		{"SET x = 'unterminated", nil},
+		{"SET x = -'a'", nil},
+		{"SET x = (1)", nil},
+		{"SELECT 1", nil},
+	}
+	for _, test := range tests {
+		if got := parseSetQuery(test.query); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseSetQuery(%q) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseSettingArgs(t *testing.T) {
+	tests := []struct {
+		args       []string
+		ignored    []string
+		settings   map[string]string
+		parameters map[string]string
+		err        string
+	}{
+		{
+			args:       []string{"--max_threads=8", "--param_id=42", "extra"},
+			ignored:    []string{"extra"},
+			settings:   map[string]string{"max_threads": "8"},
+			parameters: map[string]string{"id": "42"},
+		},
+		{
+			args:       []string{"--param_=1", "--empty="},
+			settings:   map[string]string{"param_": "1", "empty": ""},
+			parameters: map[string]string{},
+		},
+		{
+			args:       []string{"--max_threads", "8", "-x=1", "--bad-name=1"},
+			ignored:    []string{"8"},
+			settings:   map[string]string{},
+			parameters: map[string]string{},
+			err:        "Unknown options: --max_threads -x=1 --bad-name=1",
+		},
+	}
+	for _, test := range tests {
+		querySettings = make(map[string]string)
+		queryParameters = make(map[string]string)
+		settingArgs = nil
+
+		ignored, err := parseSettingArgs(test.args)
+		errText := ""
+		if err != nil {
+			errText = err.Error()
+		}
+		if !reflect.DeepEqual(ignored, test.ignored) || errText != test.err {
+			t.Errorf("parseSettingArgs(%q) = %q, %q, want %q, %q", test.args, ignored, errText, test.ignored, test.err)
+		}
+		if !reflect.DeepEqual(querySettings, test.settings) || !reflect.DeepEqual(queryParameters, test.parameters) {
+			t.Errorf("parseSettingArgs(%q): settings %v, parameters %v, want %v, %v", test.args, querySettings, queryParameters, test.settings, test.parameters)
+		}
+	}
+	querySettings = make(map[string]string)
+	queryParameters = make(map[string]string)
+	settingArgs = nil
+}
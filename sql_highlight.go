@@ -0,0 +1,126 @@
+package main
+
+// Syntax highlighting of the query while it's typed. Tokens are taken from sql_lexer, keywords and functions
+// are the ones loaded for autocomplete. Unmatched brackets and unterminated quotes are shown as errors.
+
+import (
+	"strings"
+)
+
+const (
+	highlightKeyword    = "\033[1m"
+	highlightFunction   = "\033[0;33m"
+	highlightString     = "\033[0;32m"
+	highlightNumber     = "\033[0;35m"
+	highlightIdentifier = "\033[0;36m"
+	highlightComment    = colorDim
+	highlightError      = colorError
+)
+
+// implements readline.Painter
+type sqlHighlighter struct {
+	previousLines string // lines of the statement entered before, so brackets and quotes are matched across the lines
+}
+
+func (h *sqlHighlighter) Paint(line []rune, pos int) []rune {
+	return []rune(highlightSQL(h.previousLines, string(line)))
+}
+
+// the text of the lines entered before with the line break at the end
+func joinPreviousLines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// returns the line with color escape sequences, previous lines are used only as a context
+func highlightSQL(previous, line string) string {
+	text := previous + line
+	tokens := tokenizeSQL(text)
+	unmatched := unmatchedBrackets(tokens)
+
+	var sb strings.Builder
+	for idx, token := range tokens {
+		if token.End <= len(previous) {
+			continue
+		}
+		tokenText := token.Text
+		if token.Start < len(previous) {
+			tokenText = text[len(previous):token.End]
+		}
+		color := tokenColor(tokens, idx, unmatched[idx])
+		if len(color) == 0 || len(strings.TrimSpace(tokenText)) == 0 {
+			sb.WriteString(tokenText)
+		} else {
+			sb.WriteString(color + tokenText + colorReset)
+		}
+	}
+	return sb.String()
+}
+
+var closingBrackets = map[string]string{"(": ")", "[": "]", "{": "}"}
+
+// indexes of the brackets without the pair
+func unmatchedBrackets(tokens []sqlToken) map[int]bool {
+	unmatched := make(map[int]bool)
+	var opened []int
+	for idx, token := range tokens {
+		switch token.Kind {
+		case tokenOpeningBracket:
+			opened = append(opened, idx)
+		case tokenClosingBracket:
+			if len(opened) > 0 && closingBrackets[tokens[opened[len(opened)-1]].Text] == token.Text {
+				opened = opened[:len(opened)-1]
+			} else {
+				unmatched[idx] = true
+			}
+		}
+	}
+	for _, idx := range opened {
+		unmatched[idx] = true
+	}
+	return unmatched
+}
+
+func nextMeaningfulToken(tokens []sqlToken, idx int) *sqlToken {
+	for idx++; idx < len(tokens); idx++ {
+		if tokens[idx].Kind != tokenWhitespace && tokens[idx].Kind != tokenComment {
+			return &tokens[idx]
+		}
+	}
+	return nil
+}
+
+func tokenColor(tokens []sqlToken, idx int, unmatched bool) string {
+	token := tokens[idx]
+	switch token.Kind {
+	case tokenOpeningBracket, tokenClosingBracket:
+		if unmatched {
+			return highlightError
+		}
+	case tokenString, tokenQuotedIdentifier, tokenHeredoc:
+		switch {
+		case token.Unterminated:
+			return highlightError
+		case token.Kind == tokenQuotedIdentifier:
+			return highlightIdentifier
+		}
+		return highlightString
+	case tokenComment:
+		return highlightComment
+	case tokenNumber:
+		return highlightNumber
+	case tokenBareWord:
+		// keywords first, as IN, AND, OR etc. are also functions
+		if isSQLKeyword(token.Text) {
+			return highlightKeyword
+		}
+		// names of the functions can be used for columns too
+		if next := nextMeaningfulToken(tokens, idx); next != nil && next.Text == "(" && isSQLFunction(token.Text) {
+			return highlightFunction
+		}
+		return highlightIdentifier
+	}
+	return ""
+}
@@ -0,0 +1,245 @@
+package main
+
+// Simple SQL lexer, close to the one of ClickHouse
+// https://github.com/yandex/ClickHouse/blob/master/dbms/src/Parsers/Lexer.cpp
+// It doesn't validate anything, the goal is to find boundaries of statements,
+// string literals, comments etc. without breaking on the content inside them.
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const ( // iota is reset to 0
+	tokenWhitespace       = iota
+	tokenComment          = iota
+	tokenString           = iota
+	tokenQuotedIdentifier = iota
+	tokenHeredoc          = iota
+	tokenNumber           = iota
+	tokenBareWord         = iota
+	tokenSemicolon        = iota
+	tokenOpeningBracket   = iota
+	tokenClosingBracket   = iota
+	tokenOperator         = iota
+)
+
+type sqlToken struct {
+	Kind         int
+	Start        int // byte offsets in the source
+	End          int
+	Text         string
+	Unterminated bool // string, quoted identifier, comment or heredoc without the closing part
+}
+
+func isWordStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isWordChar(r rune) bool {
+	return r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func tokenizeSQL(sql string) []sqlToken {
+	var tokens []sqlToken
+	pos := 0
+
+	for pos < len(sql) {
+		start := pos
+		kind := tokenOperator
+		unterminated := false
+
+		r, size := utf8.DecodeRuneInString(sql[pos:])
+
+		switch {
+		case unicode.IsSpace(r):
+			kind = tokenWhitespace
+			pos += size
+			for pos < len(sql) {
+				r, size = utf8.DecodeRuneInString(sql[pos:])
+				if !unicode.IsSpace(r) {
+					break
+				}
+				pos += size
+			}
+
+		case strings.HasPrefix(sql[pos:], "--"):
+			kind = tokenComment
+			if end := strings.IndexByte(sql[pos:], '\n'); end >= 0 {
+				pos += end
+			} else {
+				pos = len(sql)
+			}
+
+		case strings.HasPrefix(sql[pos:], "/*"):
+			// multiline comments can be nested
+			kind = tokenComment
+			depth := 0
+			for {
+				if pos >= len(sql) {
+					unterminated = true
+					break
+				}
+				if strings.HasPrefix(sql[pos:], "/*") {
+					depth++
+					pos += 2
+				} else if strings.HasPrefix(sql[pos:], "*/") {
+					depth--
+					pos += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					pos++
+				}
+			}
+
+		case r == '\'' || r == '"' || r == '`':
+			kind = tokenString
+			if r != '\'' {
+				kind = tokenQuotedIdentifier
+			}
+			pos, unterminated = skipQuoted(sql, pos, byte(r))
+
+		case r == '$':
+			if tagEnd := heredocTagEnd(sql, pos); tagEnd > 0 {
+				kind = tokenHeredoc
+				tag := sql[pos:tagEnd]
+				if end := strings.Index(sql[tagEnd:], tag); end >= 0 {
+					pos = tagEnd + end + len(tag)
+				} else {
+					pos = len(sql)
+					unterminated = true
+				}
+			} else {
+				pos += size
+			}
+
+		case unicode.IsDigit(r) || (r == '.' && pos+1 < len(sql) && sql[pos+1] >= '0' && sql[pos+1] <= '9' && !afterWord(tokens)):
+			kind = tokenNumber
+			pos = skipNumber(sql, pos)
+
+		case isWordStart(r):
+			kind = tokenBareWord
+			pos += size
+			for pos < len(sql) {
+				r, size = utf8.DecodeRuneInString(sql[pos:])
+				if !isWordChar(r) {
+					break
+				}
+				pos += size
+			}
+
+		case r == ';':
+			kind = tokenSemicolon
+			pos += size
+
+		case r == '(' || r == '[' || r == '{':
+			kind = tokenOpeningBracket
+			pos += size
+
+		case r == ')' || r == ']' || r == '}':
+			kind = tokenClosingBracket
+			pos += size
+
+		default:
+			pos += size
+		}
+
+		tokens = append(tokens, sqlToken{Kind: kind, Start: start, End: pos, Text: sql[start:pos], Unterminated: unterminated})
+	}
+	return tokens
+}
+
+// t.1 is a tuple element access, not a number
+func afterWord(tokens []sqlToken) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	last := tokens[len(tokens)-1]
+	return last.Kind == tokenBareWord || last.Kind == tokenQuotedIdentifier || last.Kind == tokenClosingBracket
+}
+
+// quotes inside can be escaped by backslash or by doubling
+func skipQuoted(sql string, pos int, quote byte) (int, bool) {
+	pos++
+	for pos < len(sql) {
+		switch sql[pos] {
+		case '\\':
+			pos += 2
+		case quote:
+			if pos+1 < len(sql) && sql[pos+1] == quote {
+				pos += 2
+			} else {
+				return pos + 1, false
+			}
+		default:
+			pos++
+		}
+	}
+	return len(sql), true
+}
+
+// $$ or $tag$, returns the position after the opening tag or -1
+func heredocTagEnd(sql string, pos int) int {
+	for i := pos + 1; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case c == '$':
+			return i + 1
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9'):
+		default:
+			return -1
+		}
+	}
+	return -1
+}
+
+func skipNumber(sql string, pos int) int {
+	isHex := strings.HasPrefix(sql[pos:], "0x") || strings.HasPrefix(sql[pos:], "0X")
+	for pos < len(sql) {
+		c := sql[pos]
+		switch {
+		case (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c == '.':
+			pos++
+			// exponent sign: 1e-5, 0x1p+3
+			if pos < len(sql) && (sql[pos] == '+' || sql[pos] == '-') {
+				if (!isHex && (c == 'e' || c == 'E')) || (isHex && (c == 'p' || c == 'P')) {
+					pos++
+				}
+			}
+		default:
+			return pos
+		}
+	}
+	return pos
+}
+
+// splits the script into statements by semicolons, statements without any meaningful tokens
+// (only whitespaces and comments) are skipped
+func splitQueries(script string) []string {
+	var queries []string
+	start := 0
+	meaningful := false
+
+	addQuery := func(end int) {
+		if meaningful {
+			queries = append(queries, strings.TrimSpace(script[start:end]))
+		}
+		meaningful = false
+	}
+
+	for _, token := range tokenizeSQL(script) {
+		switch token.Kind {
+		case tokenSemicolon:
+			addQuery(token.Start)
+			start = token.End
+		case tokenWhitespace, tokenComment:
+		default:
+			meaningful = true
+		}
+	}
+	addQuery(len(script))
+	return queries
+}
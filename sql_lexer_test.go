@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitQueries(t *testing.T) {
+	tests := []struct {
+		script string
+		want   []string
+	}{
+		{"SELECT 1; SELECT 2", []string{"SELECT 1", "SELECT 2"}},
+		{"SELECT 1;;\n;", []string{"SELECT 1"}},
+		{"SELECT 'it''s;'; SELECT 2", []string{"SELECT 'it''s;'", "SELECT 2"}},
+		{"SELECT 'a\\';b'", []string{"SELECT 'a\\';b'"}},
+		{"SELECT `a;b`, \"c;d\"", []string{"SELECT `a;b`, \"c;d\""}},
+		{"SELECT $$a;b$$; SELECT 2", []string{"SELECT $$a;b$$", "SELECT 2"}},
+		{"SELECT $tag$a;$$;b$tag$", []string{"SELECT $tag$a;$$;b$tag$"}},
+		{"SELECT 1 -- comment; not a query\n; SELECT 2", []string{"SELECT 1 -- comment; not a query", "SELECT 2"}},
+		{"SELECT 1; /* unterminated; comment", []string{"SELECT 1"}},
+		{"-- only comment;\n/* and this */;", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		if got := splitQueries(test.script); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitQueries(%q) = %q, want %q", test.script, got, test.want)
+		}
+	}
+}
+
+func TestTokenizeSQL(t *testing.T) {
+	type token struct {
+		Kind         int
+		Text         string
+		Unterminated bool
+	}
+	tests := []struct {
+		sql  string
+		want []token
+	}{
+		{"SELECT 1e-5", []token{{tokenBareWord, "SELECT", false}, {tokenWhitespace, " ", false}, {tokenNumber, "1e-5", false}}},
+		{"0x1p+3-1", []token{{tokenNumber, "0x1p+3", false}, {tokenOperator, "-", false}, {tokenNumber, "1", false}}},
+		{"'it''s'", []token{{tokenString, "'it''s'", false}}},
+		{"'abc", []token{{tokenString, "'abc", true}}},
+		{"/* a", []token{{tokenComment, "/* a", true}}},
+		{"$$a;b$$", []token{{tokenHeredoc, "$$a;b$$", false}}},
+		{"f(x);", []token{{tokenBareWord, "f", false}, {tokenOpeningBracket, "(", false}, {tokenBareWord, "x", false}, {tokenClosingBracket, ")", false}, {tokenSemicolon, ";", false}}},
+		{"`a b`", []token{{tokenQuotedIdentifier, "`a b`", false}}},
+	}
+	for _, test := range tests {
+		var got []token
+		for _, tk := range tokenizeSQL(test.sql) {
+			if test.sql[tk.Start:tk.End] != tk.Text {
+				t.Errorf("tokenizeSQL(%q): offsets %d:%d don't match %q", test.sql, tk.Start, tk.End, tk.Text)
+			}
+			got = append(got, token{tk.Kind, tk.Text, tk.Unterminated})
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tokenizeSQL(%q) = %v, want %v", test.sql, got, test.want)
+		}
+	}
+}